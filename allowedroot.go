@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// allowedRealRoot is the resolved --allowed-root, paths operated on have to
+// be located below it. It is empty if all paths are allowed.
+var allowedRealRoot string
+
+// setAllowedRoot resolves root in the current mount namespace and root
+// directory and restricts the paths operated on to it.
+func setAllowedRoot(root string) error {
+	path, err := NewPathNoFollow(root)
+	if err != nil {
+		return pathError(fmt.Errorf("allowed root invalid: %w", err))
+	}
+	info, err := StatAtNoFollow(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the allowed root: %w", err)
+	}
+	if !info.IsDir() {
+		return pathError(fmt.Errorf("allowed root %s is not a directory", root))
+	}
+	realPath, err := RealPathNoFollow(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the allowed root: %w", err)
+	}
+	allowedRealRoot = realPath
+	return nil
+}
+
+// checkAllowedRealPath fails if the real path is not located below the
+// allowed root and the chroot base.
+func checkAllowedRealPath(realPath string) error {
+	if chrootBaseRealPath != "" && !isBelow(chrootBaseRealPath, realPath) {
+		return pathError(fmt.Errorf("path %s escapes the chroot base %s", realPath, chrootBaseRealPath))
+	}
+	if allowedRealRoot == "" || isBelow(allowedRealRoot, realPath) {
+		return nil
+	}
+	return pathError(fmt.Errorf("path %s is outside of the allowed root %s", realPath, allowedRealRoot))
+}
+
+// checkAllowedPath fails if path does not resolve to a location below the
+// allowed root and the chroot base.
+func checkAllowedPath(path *Path) error {
+	if allowedRealRoot == "" && chrootBaseRealPath == "" {
+		return nil
+	}
+	realPath, err := RealPathNoFollow(path)
+	if err != nil {
+		return err
+	}
+	return checkAllowedRealPath(realPath)
+}
+
+// checkAllowedFile is like checkAllowedPath, but checks the held file
+// descriptor of file.
+func checkAllowedFile(file *File) error {
+	if allowedRealRoot == "" && chrootBaseRealPath == "" {
+		return nil
+	}
+	realPath, err := os.Readlink(file.SafePath())
+	if err != nil {
+		return err
+	}
+	return checkAllowedRealPath(realPath)
+}
+
+// checkAllowedChild is like checkAllowedPath for the element name of parent,
+// which may not exist yet.
+func checkAllowedChild(parent *Path, name string) error {
+	if allowedRealRoot == "" && chrootBaseRealPath == "" {
+		return nil
+	}
+	realPath, err := RealPathNoFollow(parent)
+	if err != nil {
+		return err
+	}
+	return checkAllowedRealPath(filepath.Join(realPath, name))
+}
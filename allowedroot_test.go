@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveAllowedRoot(t *testing.T) {
+	inside, outside := escapeTestFiles(t)
+	if out, err := virtChroot("--allowed-root", inside, "resolve", "--real", filepath.Join(inside, "file")).CombinedOutput(); err != nil {
+		t.Fatalf("resolve below the allowed root failed: %v\n%s", err, out)
+	}
+	out, err := virtChroot("--allowed-root", inside, "resolve", outside).CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "outside of the allowed root") {
+		t.Fatalf("resolve outside of the allowed root wasn't rejected: %v\n%s", err, out)
+	}
+}
+
+func TestListMountsAllowedRoot(t *testing.T) {
+	dir := t.TempDir()
+	allowed := filepath.Join(dir, "allowed")
+	if err := os.Mkdir(allowed, 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := mustRunInMountNamespace(t, `
+mount -t tmpfs tmpfs `+allowed+`
+$VC --allowed-root `+allowed+` list-mounts
+if $VC --allowed-root `+allowed+` list-mounts --under `+dir+` 2>/dev/null; then echo listed; fi
+`)
+	lines := strings.Split(out, "\n")
+	if len(lines) != 1 {
+		t.Fatalf("list-mounts --under outside of the allowed root wasn't rejected: %s", out)
+	}
+	var entries []MountEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].MountPoint != allowed {
+		t.Fatalf("list-mounts revealed mounts outside of the allowed root: %+v", entries)
+	}
+}
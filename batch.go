@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// batchRequest is a single command read by the batch subcommand, given as
+// the arguments of a virt-chroot invocation without global flags, e.g.
+// {"args": ["mount", "-o", "bind", "/src", "/dst"]}.
+type batchRequest struct {
+	Args []string `json:"args"`
+}
+
+// batchResult reports the outcome of a batch request.
+type batchResult struct {
+	Index  int      `json:"index"`
+	Args   []string `json:"args"`
+	Output string   `json:"output,omitempty"`
+	Error  string   `json:"error,omitempty"`
+	Exit   int      `json:"exit"`
+}
+
+// batchExcluded are the subcommands which can't run as part of a batch,
+// because they replace the process or read from stdin themselves. cp opens
+// its source on the host, before the namespaces of the batch are joined.
+var batchExcluded = map[string]bool{
+	"cp":      true,
+	"exec":    true,
+	"run":     true,
+	"batch":   true,
+	"unshare": true,
+}
+
+// runBatchCommand runs the subcommand of root named by args within the
+// current process, after the namespaces were joined and the root was changed
+// once for the whole batch. Only the flags of the subcommand itself are
+// accepted, they are reset to their defaults before parsing. The output of
+// the subcommand is returned.
+func runBatchCommand(root *cobra.Command, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", usageError(fmt.Errorf("batch request without a command"))
+	}
+	cmd, rest, err := root.Find(args)
+	if err != nil {
+		return "", usageError(err)
+	}
+	if cmd == root || cmd.RunE == nil {
+		return "", usageError(fmt.Errorf("unknown command %q", args[0]))
+	}
+	if batchExcluded[cmd.Name()] {
+		return "", usageError(fmt.Errorf("%s can't be run in a batch", cmd.Name()))
+	}
+
+	// The flags are shared with previous requests of the same subcommand.
+	flags := pflag.NewFlagSet(cmd.Name(), pflag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	var resetErr error
+	cmd.LocalNonPersistentFlags().VisitAll(func(f *pflag.Flag) {
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			resetErr = slice.Replace(nil)
+		} else if err := f.Value.Set(f.DefValue); err != nil {
+			resetErr = err
+		}
+		f.Changed = false
+		flags.AddFlag(f)
+	})
+	if resetErr != nil {
+		return "", fmt.Errorf("failed to reset the flags of %s: %w", cmd.Name(), resetErr)
+	}
+	if err := flags.Parse(rest); err != nil {
+		return "", usageError(err)
+	}
+	if err := cmd.ValidateArgs(flags.Args()); err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetIn(strings.NewReader(""))
+	err = cmd.RunE(cmd, flags.Args())
+	return out.String(), err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	cmd := virtChroot("batch", "--keep-going")
+	cmd.Stdin = strings.NewReader(`{"args": ["mkdir", "--mode", "0700", "` + dir + `/a"]}
+{"args": ["cp", "/etc/hostname", "` + dir + `/b"]}
+{"args": ["mkdir", "` + dir + `/c"]}
+`)
+	out, err := cmd.Output()
+	if err == nil {
+		t.Fatalf("batch with a failing command succeeded")
+	}
+	var results []batchResult
+	decoder := json.NewDecoder(strings.NewReader(string(out)))
+	for decoder.More() {
+		var result batchResult
+		if err := decoder.Decode(&result); err != nil {
+			t.Fatalf("invalid batch result: %v\n%s", err, out)
+		}
+		results = append(results, result)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %s", out)
+	}
+	if results[0].Exit != 0 || results[2].Exit != 0 {
+		t.Errorf("mkdir failed in batch: %s", out)
+	}
+	if results[1].Exit != exitInvalidArgument || !strings.Contains(results[1].Error, "cp can't be run in a batch") {
+		t.Errorf("cp wasn't rejected in batch: %s", out)
+	}
+	info, err := os.Stat(filepath.Join(dir, "a"))
+	if err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("unexpected directory created by batch: %v %v", info, err)
+	}
+	// the flags of the first mkdir are reset for the second
+	info, err = os.Stat(filepath.Join(dir, "c"))
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("unexpected directory created by batch: %v %v", info, err)
+	}
+}
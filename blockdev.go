@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// BlockDeviceSizeNoFollow returns the size in bytes of the block device.
+func BlockDeviceSizeNoFollow(device *File) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(device.fd, &st); err != nil {
+		return 0, fmt.Errorf("failed to stat %v: %w", device, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, fmt.Errorf("%v is not a block device", device)
+	}
+	// ioctls don't work on the O_PATH file descriptor
+	f, err := os.OpenFile(device.SafePath(), os.O_RDONLY, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open block device %v: %w", device, err)
+	}
+	defer f.Close()
+	var size uint64
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, fmt.Errorf("failed to query the size of %v: %w", device, errno)
+	}
+	return size, nil
+}
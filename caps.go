@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const capLastCapPath = "/proc/sys/kernel/cap_last_cap"
+
+var capabilities = map[string]uintptr{
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+}
+
+// parseCapabilities translates capability names like CAP_NET_ADMIN or
+// net_admin into their numbers.
+func parseCapabilities(names []string) (map[uintptr]bool, error) {
+	caps := map[uintptr]bool{}
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+		c, ok := capabilities[name]
+		if !ok {
+			return nil, fmt.Errorf("capability %s is not supported", name)
+		}
+		caps[c] = true
+	}
+	return caps, nil
+}
+
+// lastCap returns the highest capability known to the running kernel.
+func lastCap() uintptr {
+	data, err := os.ReadFile(capLastCapPath)
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	return uintptr(last)
+}
+
+// dropCapabilities removes all capabilities except keep from the bounding
+// and the inheritable set, so that they can't be regained, e.g. via file
+// capabilities, and clears the ambient set, which would otherwise be passed
+// on to the executed command. This requires CAP_SETPCAP.
+func dropCapabilities(keep map[uintptr]bool) error {
+	last := lastCap()
+	for c := uintptr(0); c <= last; c++ {
+		if keep[c] {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, c, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to drop capability %d from the bounding set: %w", c, err)
+		}
+	}
+
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to clear the ambient capabilities: %w", err)
+	}
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to get the capabilities: %w", err)
+	}
+	// Without --user the file inheritable set of root is treated as full,
+	// inheritable capabilities would survive the execve.
+	for c := uintptr(0); c <= last; c++ {
+		if !keep[c] {
+			data[c/32].Inheritable &^= 1 << (c % 32)
+		}
+	}
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to drop capabilities from the inheritable set: %w", err)
+	}
+	return nil
+}
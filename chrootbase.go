@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// chrootBase is the directory the path arguments of the subcommands are
+// relative to, set with --chroot-base. Callers joining a mount namespace can
+// pass paths as seen from e.g. the root of a container in it.
+var chrootBase string
+
+// chrootBaseRealPath is the resolved chrootBase. The real paths of the
+// resolved path arguments are verified to be below it, in addition to the
+// lexical containment of argPath.
+var chrootBaseRealPath string
+
+// setChrootBase resolves chrootBase in the current mount namespace and root
+// directory.
+func setChrootBase() error {
+	path, err := NewPathNoFollow(chrootBase)
+	if err != nil {
+		return pathError(fmt.Errorf("chroot base invalid: %w", err))
+	}
+	info, err := StatAtNoFollow(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the chroot base: %w", err)
+	}
+	if !info.IsDir() {
+		return pathError(fmt.Errorf("chroot base %s is not a directory", chrootBase))
+	}
+	realPath, err := RealPathNoFollow(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the chroot base: %w", err)
+	}
+	chrootBaseRealPath = realPath
+	return nil
+}
+
+// argPath returns the path argument path joined with chrootBase, relative
+// arguments are joined like absolute ones. Without a base the argument is
+// used as is.
+//
+// The argument is cleaned as an absolute path before it is joined, so that
+// like in a chroot .. elements stop at the base and the joined path stays
+// below the base by construction.
+func argPath(path string) string {
+	if chrootBase == "" {
+		return path
+	}
+	return UnsafeAbsolute(NewUnsafe(chrootBase, filepath.Join(pathRoot, path)))
+}
+
+// argRoot returns the root symlinks in path arguments are resolved against
+// when they are followed.
+func argRoot() string {
+	if chrootBase == "" {
+		return pathRoot
+	}
+	return chrootBase
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+// Exit codes for the error categories, documented in the help of the root command.
+const (
+	exitFailure         = 1
+	exitInvalidArgument = 2
+	exitInvalidPath     = 3
+	exitPermission      = 4
+	exitNamespace       = 5
+)
+
+// categoryError attaches an exit code to an error.
+type categoryError struct {
+	code int
+	err  error
+}
+
+func (e *categoryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categoryError) Unwrap() error {
+	return e.err
+}
+
+// commandExitError carries the exit code of a command run as a child, which
+// virt-chroot exits with without reporting an error.
+type commandExitError struct {
+	code int
+}
+
+func (e *commandExitError) Error() string {
+	return fmt.Sprintf("command exited with %d", e.code)
+}
+
+// usageError marks invalid arguments or flags.
+func usageError(err error) error {
+	return &categoryError{exitInvalidArgument, err}
+}
+
+// pathError marks failures to resolve a path without following symlinks.
+func pathError(err error) error {
+	return &categoryError{exitInvalidPath, err}
+}
+
+// namespaceError marks failures to join a namespace.
+func namespaceError(err error) error {
+	return &categoryError{exitNamespace, err}
+}
+
+// exitCode returns the exit code for err. Explicitly categorized errors take
+// precedence over permission errors of the underlying syscalls.
+func exitCode(err error) int {
+	var categorized *categoryError
+	if errors.As(err, &categorized) {
+		return categorized.code
+	}
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return exitPermission
+	}
+	return exitFailure
+}
+
+type jsonError struct {
+	Error   string `json:"error"`
+	Command string `json:"command"`
+	Exit    int    `json:"exit"`
+}
+
+func writeJSONError(w io.Writer, command string, err error) {
+	if encodeErr := json.NewEncoder(w).Encode(jsonError{err.Error(), command, exitCode(err)}); encodeErr != nil {
+		_, _ = fmt.Fprintln(w, err)
+	}
+}
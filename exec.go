@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// buildEnv assembles the environment of the executed command. It starts with
+// the environment of virt-chroot, which is dropped entirely if clear is set, or
+// reduced to the variables in keep. Afterwards the KEY=VALUE pairs in set
+// are added, replacing existing variables of the same name.
+func buildEnv(clear bool, keep []string, set []string) ([]string, error) {
+	var env []string
+	switch {
+	case len(keep) > 0:
+		for _, key := range keep {
+			if value, ok := os.LookupEnv(key); ok {
+				env = append(env, key+"="+value)
+			}
+		}
+	case !clear:
+		env = os.Environ()
+	}
+
+	for _, kv := range set {
+		key, _, found := strings.Cut(kv, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("environment variable %q must be of the form KEY=VALUE", kv)
+		}
+		filtered := make([]string, 0, len(env)+1)
+		for _, existing := range env {
+			if !strings.HasPrefix(existing, key+"=") {
+				filtered = append(filtered, existing)
+			}
+		}
+		env = append(filtered, kv)
+	}
+	return env, nil
+}
+
+// keepFds clears FD_CLOEXEC on the file descriptors, so that they are
+// inherited by the executed command. All of them have to be open.
+func keepFds(fds []int) error {
+	for _, fd := range fds {
+		if fd < 0 {
+			return fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+		if err != nil {
+			return fmt.Errorf("file descriptor %d is not open: %w", fd, err)
+		}
+		if _, err := unix.FcntlInt(uintptr(fd), unix.F_SETFD, flags&^unix.FD_CLOEXEC); err != nil {
+			return fmt.Errorf("failed to keep file descriptor %d open: %w", fd, err)
+		}
+	}
+	return nil
+}
+
+// forwardedSignals are relayed to a command run as a child, so that e.g. the
+// termination of a pod reaches it.
+var forwardedSignals = []os.Signal{
+	syscall.SIGTERM,
+	syscall.SIGINT,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+}
+
+// writePidFile writes pid to the file at path with mode 0600. The file is
+// resolved below the root and --chroot-base like all other paths and
+// replaced atomically, so that readers never see a partial pid.
+func writePidFile(path string, pid int) error {
+	parent, name, err := NewParentNoFollow(argPath(path))
+	if err != nil {
+		return pathError(fmt.Errorf("pid file invalid: %w", err))
+	}
+	if err := checkAllowedChild(parent, name); err != nil {
+		return err
+	}
+	err = WriteFileAtomicNoFollow(parent, name, strings.NewReader(strconv.Itoa(pid)+"\n"), 0600, true)
+	if err != nil {
+		return fmt.Errorf("failed to write pid file: %w", err)
+	}
+	logger.Info("wrote pid file", "path", path, "pid", pid)
+	return nil
+}
+
+// runWithTimeout runs the command as a child instead of replacing the process
+// and waits for it, forwarding the signals in forwardedSignals. Once timeout
+// expired, the child is sent SIGTERM, and SIGKILL if it is still running
+// after killAfter. A zero timeout never expires. started is called with the
+// pid of the child once it exists, if it fails the child is killed.
+func runWithTimeout(path string, argv, env []string, timeout, killAfter time.Duration, started func(pid int) error) (syscall.WaitStatus, error) {
+	// Subscribe before the child exists, signals arriving in between are
+	// queued and forwarded once it is started.
+	signals := make(chan os.Signal, len(forwardedSignals))
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	pid, err := syscall.ForkExec(path, argv, &syscall.ProcAttr{
+		Env:   env,
+		Files: []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := started(pid); err != nil {
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+		var status syscall.WaitStatus
+		_, _ = syscall.Wait4(pid, &status, 0, nil)
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-signals:
+				logger.Info("forwarding signal to the command", "pid", pid, "signal", sig.String())
+				_ = syscall.Kill(pid, sig.(syscall.Signal))
+			}
+		}
+	}()
+	if timeout > 0 {
+		go func() {
+			select {
+			case <-done:
+				return
+			case <-time.After(timeout):
+			}
+			logger.Info("timeout expired, terminating the command", "pid", pid, "timeout", timeout)
+			_ = syscall.Kill(pid, syscall.SIGTERM)
+			select {
+			case <-done:
+			case <-time.After(killAfter):
+				logger.Info("command did not terminate, killing it", "pid", pid)
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}()
+	}
+
+	var status syscall.WaitStatus
+	for {
+		_, err = syscall.Wait4(pid, &status, 0, nil)
+		if !errors.Is(err, syscall.EINTR) {
+			break
+		}
+	}
+	// the pid may be reused once the child is reaped
+	close(done)
+	if err != nil {
+		return 0, fmt.Errorf("failed to wait for the command: %w", err)
+	}
+	return status, nil
+}
+
+// exitStatus returns the exit code of virt-chroot for the wait status of the
+// command. Like shells do, the death by a signal is reported as 128 plus the
+// signal number.
+func exitStatus(status syscall.WaitStatus) int {
+	switch {
+	case status.Exited():
+		return status.ExitStatus()
+	case status.Signaled():
+		return 128 + int(status.Signal())
+	default:
+		return exitFailure
+	}
+}
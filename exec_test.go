@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestExitStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status syscall.WaitStatus
+		code   int
+	}{
+		{"success", 0, 0},
+		{"failure", 3 << 8, 3},
+		{"max", 255 << 8, 255},
+		{"sigkill", syscall.WaitStatus(syscall.SIGKILL), 128 + 9},
+		{"sigterm", syscall.WaitStatus(syscall.SIGTERM), 128 + 15},
+		// stopped with SIGSTOP
+		{"stopped", syscall.WaitStatus(syscall.SIGSTOP<<8 | 0x7f), exitFailure},
+	} {
+		if code := exitStatus(tc.status); code != tc.code {
+			t.Errorf("%s: exit status of %#x is %d instead of %d", tc.name, int(tc.status), code, tc.code)
+		}
+	}
+}
+
+func TestExecChildExitStatus(t *testing.T) {
+	for _, tc := range []struct {
+		script string
+		code   int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -KILL $$", 128 + 9},
+	} {
+		err := virtChroot("exec", "--timeout", "1m", "--", "/bin/sh", "-c", tc.script).Run()
+		code := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if code != tc.code {
+			t.Errorf("%q exited with %d instead of %d", tc.script, code, tc.code)
+		}
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	t.Setenv("VIRT_CHROOT_TEST_A", "a")
+	t.Setenv("VIRT_CHROOT_TEST_B", "b")
+	for _, tc := range []struct {
+		name  string
+		clear bool
+		keep  []string
+		set   []string
+		env   []string
+		valid bool
+	}{
+		{"clear", true, nil, nil, nil, true},
+		{"clear-set", true, nil, []string{"A=1", "B=2"}, []string{"A=1", "B=2"}, true},
+		{"replace", true, nil, []string{"A=1", "A=2"}, []string{"A=2"}, true},
+		{"empty-value", true, nil, []string{"A="}, []string{"A="}, true},
+		{"value-with-equals", true, nil, []string{"A=b=c"}, []string{"A=b=c"}, true},
+		{"keep", false, []string{"VIRT_CHROOT_TEST_B", "VIRT_CHROOT_TEST_UNSET"}, nil, []string{"VIRT_CHROOT_TEST_B=b"}, true},
+		{"keep-replace", false, []string{"VIRT_CHROOT_TEST_A"}, []string{"VIRT_CHROOT_TEST_A=x"}, []string{"VIRT_CHROOT_TEST_A=x"}, true},
+		// keep takes precedence over clear
+		{"keep-clear", true, []string{"VIRT_CHROOT_TEST_A"}, nil, []string{"VIRT_CHROOT_TEST_A=a"}, true},
+		{"no-value", true, nil, []string{"A"}, nil, false},
+		{"no-key", true, nil, []string{"=a"}, nil, false},
+	} {
+		env, err := buildEnv(tc.clear, tc.keep, tc.set)
+		if tc.valid != (err == nil) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if tc.valid && !reflect.DeepEqual(env, tc.env) {
+			t.Errorf("%s: environment is %v instead of %v", tc.name, env, tc.env)
+		}
+	}
+
+	env, err := buildEnv(false, nil, []string{"VIRT_CHROOT_TEST_A=x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined := "\n" + strings.Join(env, "\n") + "\n"
+	if !strings.Contains(joined, "\nVIRT_CHROOT_TEST_A=x\n") || strings.Contains(joined, "\nVIRT_CHROOT_TEST_A=a\n") ||
+		!strings.Contains(joined, "\nVIRT_CHROOT_TEST_B=b\n") {
+		t.Errorf("inherited environment wasn't updated: %v", env)
+	}
+}
+
+func TestFileSizeLimit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	out, err := virtChroot("--fsize", "1024", "exec", "--", "/bin/sh", "-c", "head -c 4096 /dev/zero > "+file+"; echo $?").CombinedOutput()
+	if err != nil {
+		t.Fatalf("exec failed: %v\n%s", err, out)
+	}
+	// 128 + SIGXFSZ
+	if !strings.HasSuffix(string(out), "153\n") {
+		t.Errorf("writing past the limit wasn't stopped by SIGXFSZ: %s", out)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 1024 {
+		t.Errorf("file grew to %d bytes past the limit", info.Size())
+	}
+}
+
+func TestExecDoesNotLeakFds(t *testing.T) {
+	dir := t.TempDir()
+	// none of the descriptors opened for the bind mount may reach the
+	// command, ls itself opens the listed directory as fd 3
+	out := mustRunInMountNamespace(t, `
+cd `+dir+`
+mkdir src dst
+$VC run --bind `+dir+`/src:`+dir+`/dst -- /bin/ls /proc/self/fd
+`)
+	if fds := strings.Fields(out); !reflect.DeepEqual(fds, []string{"0", "1", "2", "3"}) {
+		t.Errorf("the executed command inherited the file descriptors %v", fds)
+	}
+}
+
+func TestExecKeepFd(t *testing.T) {
+	kept, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kept.Close()
+	cmd := virtChroot("exec", "--keep-fd", "3", "--", "/bin/ls", "/proc/self/fd")
+	cmd.ExtraFiles = []*os.File{kept}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("exec failed: %v\n%s", err, out)
+	}
+	// fd 3 stays open despite close-on-exec, ls opens the directory as fd 4
+	if fds := strings.Fields(string(out)); !reflect.DeepEqual(fds, []string{"0", "1", "2", "3", "4"}) {
+		t.Errorf("the executed command inherited the file descriptors %v", fds)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// parseFileMode parses an octal file mode like 0644.
+func parseFileMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q: %w", mode, err)
+	}
+	if m > 07777 {
+		return 0, fmt.Errorf("invalid file mode %q", mode)
+	}
+	return fileModeFromUnix(uint32(m)), nil
+}
+
+// fileModeFromUnix converts the permission bits of a unix mode to an os.FileMode.
+func fileModeFromUnix(m uint32) os.FileMode {
+	mode := os.FileMode(m) & os.ModePerm
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+var sizeSuffixes = []struct {
+	suffix     string
+	multiplier uint64
+}{
+	// binary suffixes first, so that e.g. Gi is not parsed as G
+	{"Ki", 1 << 10},
+	{"Mi", 1 << 20},
+	{"Gi", 1 << 30},
+	{"Ti", 1 << 40},
+	{"Pi", 1 << 50},
+	{"k", 1e3},
+	{"K", 1e3},
+	{"M", 1e6},
+	{"G", 1e9},
+	{"T", 1e12},
+	{"P", 1e15},
+}
+
+// parseSize parses a size in bytes with an optional decimal (k, M, G, T, P)
+// or binary (Ki, Mi, Gi, Ti, Pi) suffix, e.g. 10Gi.
+func parseSize(size string) (uint64, error) {
+	number := size
+	multiplier := uint64(1)
+	for _, s := range sizeSuffixes {
+		if strings.HasSuffix(size, s.suffix) {
+			number = strings.TrimSuffix(size, s.suffix)
+			multiplier = s.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", size, err)
+	}
+	if n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("size %q is too large", size)
+	}
+	return n * multiplier, nil
+}
+
+// formatSize formats a size in bytes with the largest binary suffix which
+// keeps the value at or above one, e.g. 1.5Gi.
+func formatSize(size uint64) string {
+	for i := len(sizeSuffixes) - 1; i >= 0; i-- {
+		s := sizeSuffixes[i]
+		if strings.HasSuffix(s.suffix, "i") && size >= s.multiplier {
+			return strconv.FormatFloat(float64(size)/float64(s.multiplier), 'f', 1, 64) + s.suffix
+		}
+	}
+	return strconv.FormatUint(size, 10)
+}
+
+// RealPathNoFollow returns the path the kernel reports for the file
+// descriptor of path in the current mount namespace and root.
+func RealPathNoFollow(path *Path) (string, error) {
+	var realPath string
+	err := path.ExecuteNoFollow(func(safePath string) (err error) {
+		realPath, err = os.Readlink(safePath)
+		return err
+	})
+	return realPath, err
+}
+
+// NewFileFromFd wraps a copy of the inherited file descriptor fd, like one
+// passed with --keep-fd by the caller, into a File. Only directories, regular
+// files and devices are accepted. The path of the file is taken from the file
+// descriptor and only informational.
+func NewFileFromFd(fd int) (*File, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return nil, fmt.Errorf("file descriptor %d is not usable: %w", fd, err)
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR, unix.S_IFREG, unix.S_IFBLK, unix.S_IFCHR:
+	default:
+		return nil, fmt.Errorf("file descriptor %d refers to a %s, expected a directory, file or device", fd, fileTypeName(st.Mode))
+	}
+	target, err := os.Readlink(path(fd))
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d is not usable: %w", fd, err)
+	}
+	if !filepath.IsAbs(target) {
+		return nil, fmt.Errorf("file descriptor %d refers to %s, which is not reachable by path", fd, target)
+	}
+	dup, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to duplicate file descriptor %d: %w", fd, err)
+	}
+	return &File{fd: dup, path: newPath("/", target)}, nil
+}
+
+// NewParentNoFollow resolves the parent directory of an absolute path like
+// NewPathNoFollow and returns it together with the final path element, which
+// is not resolved and may not exist yet.
+func NewParentNoFollow(path string) (*Path, string, error) {
+	if filepath.Clean(path) != path || !filepath.IsAbs(path) {
+		return nil, "", fmt.Errorf("path %q must be absolute and must not contain relative elements", path)
+	}
+	parent, err := NewPathNoFollow(filepath.Dir(path))
+	if err != nil {
+		return nil, "", err
+	}
+	name := filepath.Base(path)
+	if err := isSingleElement(name); err != nil {
+		return nil, "", err
+	}
+	return parent, name, nil
+}
+
+// MkdirAllNoFollow creates the directory at the absolute path including all
+// missing parents. Every element is created relative to its already resolved
+// parent, existing elements must be directories and no symlinks are followed.
+func MkdirAllNoFollow(path string, mode os.FileMode) error {
+	if filepath.Clean(path) != path || !filepath.IsAbs(path) {
+		return fmt.Errorf("path %q must be absolute and must not contain relative elements", path)
+	}
+	current, err := NewPathNoFollow(pathRoot)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(path, pathSeparator) {
+		if name == "" {
+			continue
+		}
+		next, err := JoinNoFollow(current, name)
+		if errors.Is(err, os.ErrNotExist) {
+			if err := mkdirExact(current, name, mode); err != nil {
+				return err
+			}
+			next, err = JoinNoFollow(current, name)
+		}
+		if err != nil {
+			return err
+		}
+		info, err := StatAtNoFollow(next)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("path %v is not a directory", next)
+		}
+		current = next
+	}
+	return nil
+}
+
+// mkdirExact creates the directory with exactly the given mode, independent of the umask.
+func mkdirExact(parent *Path, name string, mode os.FileMode) error {
+	if err := MkdirAtNoFollow(parent, name, mode.Perm()); err != nil {
+		return err
+	}
+	dir, err := JoinNoFollow(parent, name)
+	if err != nil {
+		return err
+	}
+	return ChmodAtNoFollow(dir, mode)
+}
+
+// RemoveAllNoFollow deletes the file or directory at path including all of
+// its content. The tree is walked depth-first relative to file descriptors of
+// the already opened parents, symlinks are removed and never followed.
+func RemoveAllNoFollow(path *Path) error {
+	parent, err := path.DirNoFollow()
+	if err != nil {
+		return err
+	}
+	name, err := path.Base()
+	if err != nil {
+		return err
+	}
+	fd, err := OpenAtNoFollow(parent)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err := removeAllAt(fd.fd, name); err != nil {
+		return fmt.Errorf("failed removing path %v: %w", path, err)
+	}
+	return nil
+}
+
+func removeAllAt(dirfd int, name string) error {
+	if err := isSingleElement(name); err != nil {
+		return err
+	}
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.ELOOP) {
+		// not a directory or a symlink, which is removed itself
+		return unlinkat(dirfd, name, 0)
+	}
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	defer dir.Close()
+	for {
+		names, err := dir.Readdirnames(128)
+		for _, child := range names {
+			if err := removeAllAt(fd, child); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+}
+
+// FileStat is the metadata of a file as reported by the stat subcommand.
+type FileStat struct {
+	Path        string    `json:"path"`
+	Type        string    `json:"type"`
+	Size        int64     `json:"size"`
+	Mode        string    `json:"mode"`
+	UID         uint32    `json:"uid"`
+	GID         uint32    `json:"gid"`
+	Mtime       time.Time `json:"mtime"`
+	BlockDevice bool      `json:"blockDevice"`
+	CharDevice  bool      `json:"charDevice"`
+}
+
+// FstatNoFollow returns the metadata of the file behind the already opened file descriptor.
+func FstatNoFollow(f *File) (*FileStat, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(f.fd, &st); err != nil {
+		return nil, fmt.Errorf("failed to stat %v: %w", f.Path(), err)
+	}
+	fileType := fileTypeName(st.Mode)
+	return &FileStat{
+		Path:        UnsafeAbsolute(f.Path().Raw()),
+		Type:        fileType,
+		Size:        st.Size,
+		Mode:        fmt.Sprintf("%04o", st.Mode&07777),
+		UID:         st.Uid,
+		GID:         st.Gid,
+		Mtime:       time.Unix(st.Mtim.Unix()),
+		BlockDevice: fileType == "block",
+		CharDevice:  fileType == "char",
+	}, nil
+}
+
+func fileTypeName(mode uint32) string {
+	switch mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		return "file"
+	case unix.S_IFDIR:
+		return "directory"
+	case unix.S_IFLNK:
+		return "symlink"
+	case unix.S_IFBLK:
+		return "block"
+	case unix.S_IFCHR:
+		return "char"
+	case unix.S_IFIFO:
+		return "fifo"
+	case unix.S_IFSOCK:
+		return "socket"
+	default:
+		return "unknown"
+	}
+}
+
+// LchownAtNoFollow changes the ownership of name relative to the already
+// resolved parent. If name is a symlink, the symlink itself is changed.
+// An uid or gid of -1 is left unchanged.
+func LchownAtNoFollow(parent *Path, name string, uid, gid int) error {
+	if err := isSingleElement(name); err != nil {
+		return err
+	}
+	f, err := OpenAtNoFollow(parent)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Fchownat(f.fd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("failed changing ownership of %s in %v: %w", name, parent, err)
+	}
+	return nil
+}
+
+// TruncateAtNoFollow sets the size of the regular file at path. With allocate,
+// the space is allocated on disk instead of leaving the file sparse.
+func TruncateAtNoFollow(path *Path, size int64, allocate bool) error {
+	f, err := OpenAtNoFollow(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := FstatNoFollow(f)
+	if err != nil {
+		return err
+	}
+	if info.Type != "file" {
+		return fmt.Errorf("path %v is not a regular file", path)
+	}
+	// reopen the file via the file descriptor path, O_PATH descriptors
+	// can't be written to
+	file, err := os.OpenFile(f.SafePath(), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := unix.Ftruncate(int(file.Fd()), size); err != nil {
+		return fmt.Errorf("failed truncating %v: %w", path, err)
+	}
+	if allocate && size > 0 {
+		if err := unix.Fallocate(int(file.Fd()), 0, 0, size); err != nil {
+			return fmt.Errorf("failed allocating %v: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// SymlinkAtNoFollow creates a symlink named name relative to the already
+// resolved parent. The target is stored verbatim.
+func SymlinkAtNoFollow(target string, parent *Path, name string) error {
+	if err := isSingleElement(name); err != nil {
+		return err
+	}
+	f, err := OpenAtNoFollow(parent)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Symlinkat(target, f.fd, name); err != nil {
+		return fmt.Errorf("failed creating symlink %s in %v: %w", name, parent, err)
+	}
+	return nil
+}
+
+// ReadlinkAtNoFollow returns the target of the symlink name relative to the
+// already resolved parent. The symlink itself is not followed.
+func ReadlinkAtNoFollow(parent *Path, name string) (string, error) {
+	if err := isSingleElement(name); err != nil {
+		return "", err
+	}
+	f, err := OpenAtNoFollow(parent)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for size := 128; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(f.fd, name, buf)
+		if err != nil {
+			return "", fmt.Errorf("failed reading symlink %s in %v: %w", name, parent, err)
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// WriteFileAtomicNoFollow writes the content of r to name relative to the
+// already resolved parent. The content is written to a temporary file next to
+// the destination, synced and then renamed over the destination, so that it
+// never contains partial content. The temporary file is created with mode,
+// subject to the umask, unless exactMode is set.
+func WriteFileAtomicNoFollow(parent *Path, name string, r io.Reader, mode os.FileMode, exactMode bool) (err error) {
+	if err := isSingleElement(name); err != nil {
+		return err
+	}
+	dir, err := OpenAtNoFollow(parent)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmpName := "." + name + "." + hex.EncodeToString(suffix) + ".tmp"
+	fd, err := unix.Openat(dir.fd, tmpName, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(mode.Perm()))
+	if err != nil {
+		return fmt.Errorf("failed creating temporary file in %v: %w", parent, err)
+	}
+	tmp := os.NewFile(uintptr(fd), tmpName)
+	defer func() {
+		_ = tmp.Close()
+		if err != nil {
+			_ = unlinkat(dir.fd, tmpName, 0)
+		}
+	}()
+
+	if exactMode {
+		if err := tmp.Chmod(mode); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		return fmt.Errorf("failed writing %s in %v: %w", name, parent, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed syncing %s in %v: %w", name, parent, err)
+	}
+	if err := unix.Renameat(dir.fd, tmpName, dir.fd, name); err != nil {
+		return fmt.Errorf("failed renaming to %s in %v: %w", name, parent, err)
+	}
+	return nil
+}
+
+// DirEntry is a directory entry as reported by the ls subcommand. Path is
+// relative to the listed directory.
+type DirEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Type string `json:"type"`
+}
+
+// ReadDirNoFollow lists the entries of the directory at path. With maxDepth
+// greater than one, subdirectories are listed too, down to maxDepth levels.
+// All directories are read from file descriptors opened relative to their
+// already opened parent and symlinks are never followed.
+func ReadDirNoFollow(path *Path, maxDepth int) ([]DirEntry, error) {
+	f, err := OpenAtNoFollow(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []DirEntry{}
+	if err := readDirAt(f.fd, ".", "", maxDepth, &entries); err != nil {
+		return nil, fmt.Errorf("failed listing %v: %w", path, err)
+	}
+	return entries, nil
+}
+
+func readDirAt(dirfd int, name string, prefix string, depth int, entries *[]DirEntry) error {
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	// file descriptor path as name, so that lookups of the os package
+	// happen relative to the opened directory
+	dir := os.NewFile(uintptr(fd), path(fd))
+	defer dir.Close()
+	children, err := dir.ReadDir(-1)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		entry := DirEntry{
+			Name: child.Name(),
+			Path: filepath.Join(prefix, child.Name()),
+			Type: fileModeTypeName(child.Type()),
+		}
+		*entries = append(*entries, entry)
+		if child.IsDir() && depth > 1 {
+			if err := readDirAt(fd, child.Name(), entry.Path, depth-1, entries); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func fileModeTypeName(mode fs.FileMode) string {
+	switch mode.Type() {
+	case 0:
+		return "file"
+	case fs.ModeDir:
+		return "directory"
+	case fs.ModeSymlink:
+		return "symlink"
+	case fs.ModeDevice:
+		return "block"
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return "char"
+	case fs.ModeNamedPipe:
+		return "fifo"
+	case fs.ModeSocket:
+		return "socket"
+	default:
+		return "unknown"
+	}
+}
+
+// SyncNoFollow flushes the file to disk. With dataOnly, only the data and the
+// metadata required to read it back are flushed.
+func SyncNoFollow(file *File, dataOnly bool) error {
+	// fsync doesn't work on the O_PATH file descriptor, don't block on fifos
+	f, err := os.OpenFile(file.SafePath(), os.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %v: %w", file, err)
+	}
+	defer f.Close()
+	if dataOnly {
+		err = unix.Fdatasync(int(f.Fd()))
+	} else {
+		err = unix.Fsync(int(f.Fd()))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sync %v: %w", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// escapeTestFiles creates a directory with a file inside and a file outside
+// of it, which a test tries to reach through symlinks.
+func escapeTestFiles(t *testing.T) (inside, outside string) {
+	t.Helper()
+	dir := t.TempDir()
+	inside, outside = filepath.Join(dir, "inside"), filepath.Join(dir, "outside")
+	if err := os.Mkdir(inside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outside, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inside, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return inside, outside
+}
+
+func modeOf(t *testing.T, path string) os.FileMode {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Mode().Perm()
+}
+
+func TestChmodDoesNotFollowSymlinks(t *testing.T) {
+	inside, outside := escapeTestFiles(t)
+	link := filepath.Join(inside, "link")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := virtChroot("chmod", "0600", link).CombinedOutput(); err == nil {
+		t.Fatalf("chmod of a symlink succeeded: %s", out)
+	}
+	parentLink := filepath.Join(inside, "parent")
+	if err := os.Symlink(filepath.Dir(outside), parentLink); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := virtChroot("chmod", "0600", filepath.Join(parentLink, "outside")).CombinedOutput(); err == nil {
+		t.Fatalf("chmod through a symlinked parent succeeded: %s", out)
+	}
+	if mode := modeOf(t, outside); mode != 0644 {
+		t.Fatalf("chmod escaped through a symlink, mode is %v", mode)
+	}
+	if out, err := virtChroot("chmod", "--follow", "0640", link).CombinedOutput(); err != nil {
+		t.Fatalf("chmod --follow failed: %v\n%s", err, out)
+	}
+	if mode := modeOf(t, outside); mode != 0640 {
+		t.Fatalf("chmod --follow didn't change the target, mode is %v", mode)
+	}
+}
+
+func TestChmodHeldFileAfterSymlinkSwap(t *testing.T) {
+	inside, outside := escapeTestFiles(t)
+	file := filepath.Join(inside, "file")
+	path, err := NewPathNoFollow(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenAtNoFollow(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// swap the checked file with a symlink before the mode is changed
+	if err := os.Rename(file, file+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, file); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(f.SafePath(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if mode := modeOf(t, outside); mode != 0644 {
+		t.Fatalf("the mode of the symlink target was changed to %v", mode)
+	}
+	if mode := modeOf(t, file+".moved"); mode != 0600 {
+		t.Fatalf("the mode of the held file is %v", mode)
+	}
+}
+
+func TestCopyFromHostWithChrootBase(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	for _, d := range []string{base, filepath.Join(base, dir), filepath.Join(base, "dst")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source := filepath.Join(dir, "source")
+	if err := os.WriteFile(source, []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a decoy at the same path below the base
+	if err := os.WriteFile(filepath.Join(base, source), []byte("base"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := virtChroot("--chroot-base", base, "cp", source, "/dst/file").CombinedOutput(); err != nil {
+		t.Fatalf("cp failed: %v\n%s", err, out)
+	}
+	content, err := os.ReadFile(filepath.Join(base, "dst", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "host" {
+		t.Fatalf("cp copied %q instead of the host file", content)
+	}
+}
+
+func ownerOf(t *testing.T, path string) (int, int) {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	return int(st.Uid), int(st.Gid)
+}
+
+func TestChown(t *testing.T) {
+	requireRoot(t)
+	inside, outside := escapeTestFiles(t)
+	file := filepath.Join(inside, "file")
+	for _, tc := range []struct {
+		uid, gid         string
+		wantUID, wantGID int
+	}{
+		{"1000", "2000", 1000, 2000},
+		// -1 leaves the owner or group unchanged
+		{"-1", "3000", 1000, 3000},
+		{"4000", "-1", 4000, 3000},
+	} {
+		if out, err := virtChroot("chown", "--uid", tc.uid, "--gid", tc.gid, file).CombinedOutput(); err != nil {
+			t.Fatalf("chown failed: %v\n%s", err, out)
+		}
+		if uid, gid := ownerOf(t, file); uid != tc.wantUID || gid != tc.wantGID {
+			t.Errorf("chown %s:%s resulted in %d:%d", tc.uid, tc.gid, uid, gid)
+		}
+	}
+
+	// the ownership of a symlink itself is changed, not of its target
+	link := filepath.Join(inside, "link")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := virtChroot("chown", "--uid", "1000", "--gid", "1000", link).CombinedOutput(); err != nil {
+		t.Fatalf("chown of a symlink failed: %v\n%s", err, out)
+	}
+	if uid, gid := ownerOf(t, link); uid != 1000 || gid != 1000 {
+		t.Errorf("the symlink is owned by %d:%d", uid, gid)
+	}
+	if uid, gid := ownerOf(t, outside); uid != 0 || gid != 0 {
+		t.Errorf("chown followed the symlink to its target, owned by %d:%d", uid, gid)
+	}
+
+	// a symlinked parent is not followed
+	parentLink := filepath.Join(inside, "parent")
+	if err := os.Symlink(filepath.Dir(outside), parentLink); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := virtChroot("chown", "--uid", "1000", filepath.Join(parentLink, "outside")).CombinedOutput(); err == nil {
+		t.Fatalf("chown through a symlinked parent succeeded: %s", out)
+	}
+	if uid, _ := ownerOf(t, outside); uid != 0 {
+		t.Errorf("chown escaped through a symlinked parent")
+	}
+}
+
+func TestChownAfterParentSwap(t *testing.T) {
+	requireRoot(t)
+	inside, _ := escapeTestFiles(t)
+	outsideDir := filepath.Join(filepath.Dir(inside), "outside-dir")
+	if err := os.Mkdir(outsideDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outsideDir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	parent, name, err := NewParentNoFollow(filepath.Join(inside, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// swap the checked parent with a symlink before the ownership is changed
+	if err := os.Rename(inside, inside+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outsideDir, inside); err != nil {
+		t.Fatal(err)
+	}
+	if err := LchownAtNoFollow(parent, name, 1000, 1000); err == nil {
+		t.Errorf("chown through the swapped parent succeeded")
+	}
+	if uid, _ := ownerOf(t, filepath.Join(outsideDir, "file")); uid != 0 {
+		t.Errorf("chown escaped through the swapped parent")
+	}
+}
+
+func TestMknod(t *testing.T) {
+	requireRoot(t)
+	node := filepath.Join(t.TempDir(), "loop0")
+	if out, err := virtChroot("mknod", "--mode", "0640", node, "b", "7", "0").CombinedOutput(); err != nil {
+		t.Fatalf("mknod failed: %v\n%s", err, out)
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(node, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		t.Errorf("node is not a block device: %o", st.Mode)
+	}
+	if major, minor := unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)); major != 7 || minor != 0 {
+		t.Errorf("node is %d:%d instead of 7:0", major, minor)
+	}
+	if mode := st.Mode & 07777; mode != 0640 {
+		t.Errorf("node has mode %o instead of 0640", mode)
+	}
+}
+
+func TestMknodInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"mknod", filepath.Join(dir, "major"), "b", "4096", "0"},
+		{"mknod", filepath.Join(dir, "minor"), "c", "1", "1048576"},
+		{"mknod", filepath.Join(dir, "type"), "p", "1", "3"},
+		{"--user", "nobody", "mknod", filepath.Join(dir, "user"), "c", "1", "3"},
+	} {
+		err := virtChroot(args...).Run()
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() != exitInvalidArgument {
+			t.Errorf("%v wasn't rejected as invalid: %v", args, err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("invalid mknod created %v", entries)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "link")
+	// the target is kept verbatim, even if it doesn't exist or leaves the directory
+	target := "../missing/./target"
+	if out, err := virtChroot("symlink", target, link).CombinedOutput(); err != nil {
+		t.Fatalf("symlink failed: %v\n%s", err, out)
+	}
+	if got, err := os.Readlink(link); err != nil || got != target {
+		t.Errorf("link points to %q instead of %q: %v", got, target, err)
+	}
+	out, err := virtChroot("symlink", "other", link).CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "already exists") {
+		t.Errorf("replacing an existing link wasn't rejected: %v\n%s", err, out)
+	}
+	if got, _ := os.Readlink(link); got != target {
+		t.Errorf("existing link was changed to %q", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		size  string
+		bytes uint64
+		valid bool
+	}{
+		{"0", 0, true},
+		{"4096", 4096, true},
+		{"1k", 1000, true},
+		{"1K", 1000, true},
+		{"1Ki", 1024, true},
+		{"10M", 10e6, true},
+		{"10Mi", 10 << 20, true},
+		{"2Gi", 2 << 30, true},
+		{"8191Pi", 8191 << 50, true},
+		{"8192Pi", 0, false},
+		{"", 0, false},
+		{"Gi", 0, false},
+		{"-1", 0, false},
+		{"1.5G", 0, false},
+		{"1x", 0, false},
+	} {
+		bytes, err := parseSize(tc.size)
+		if tc.valid != (err == nil) {
+			t.Errorf("parsing %q returned error %v", tc.size, err)
+			continue
+		}
+		if bytes != tc.bytes {
+			t.Errorf("parsing %q returned %d instead of %d", tc.size, bytes, tc.bytes)
+		}
+	}
+}
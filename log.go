@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+)
+
+// logger reports the steps taken with --verbose, it discards everything by
+// default so that callers see no additional output.
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// setupLogging logs to w at info level with verbosity 1 and at debug level
+// with higher verbosity. With json, records are written as JSON objects.
+func setupLogging(w io.Writer, verbosity int, json bool) {
+	if verbosity == 0 {
+		return
+	}
+	level := slog.LevelInfo
+	if verbosity > 1 {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if json {
+		logger = slog.New(slog.NewJSONHandler(w, opts))
+	} else {
+		logger = slog.New(slog.NewTextHandler(w, opts))
+	}
+}
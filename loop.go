@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	loopControlPath = "/dev/loop-control"
+	// other processes may grab the free device before us
+	loopAttachAttempts = 10
+)
+
+// AttachLoopNoFollow associates the already opened backing file with a free
+// loop device and returns the path of the device.
+func AttachLoopNoFollow(backing *File, readOnly bool) (string, error) {
+	flags := os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	// reopen the file via the file descriptor path, O_PATH descriptors can't be
+	// handed to the loop driver
+	backingFile, err := os.OpenFile(backing.SafePath(), flags, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to open backing file %v: %w", backing, err)
+	}
+	defer backingFile.Close()
+
+	control, err := os.OpenFile(loopControlPath, os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", loopControlPath, err)
+	}
+	defer control.Close()
+
+	for i := 0; i < loopAttachAttempts; i++ {
+		n, err := unix.IoctlRetInt(int(control.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return "", fmt.Errorf("failed to find a free loop device: %w", err)
+		}
+		device := fmt.Sprintf("/dev/loop%d", n)
+		err = attachLoop(device, backingFile, UnsafeAbsolute(backing.Path().Raw()), flags)
+		if errors.Is(err, syscall.EBUSY) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return device, nil
+	}
+	return "", fmt.Errorf("failed to attach a loop device after %d attempts", loopAttachAttempts)
+}
+
+func attachLoop(device string, backingFile *os.File, backingName string, flags int) error {
+	deviceFile, err := NewFileNoFollow(device)
+	if err != nil {
+		return err
+	}
+	defer deviceFile.Close()
+	loop, err := os.OpenFile(deviceFile.SafePath(), flags, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open loop device %s: %w", device, err)
+	}
+	defer loop.Close()
+
+	if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backingFile.Fd())); err != nil {
+		return fmt.Errorf("failed to attach %s: %w", device, err)
+	}
+	info := &unix.LoopInfo64{}
+	copy(info.File_name[:unix.LO_NAME_SIZE-1], backingName)
+	if err := unix.IoctlLoopSetStatus64(int(loop.Fd()), info); err != nil {
+		_ = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+		return fmt.Errorf("failed to set status of %s: %w", device, err)
+	}
+	return nil
+}
+
+// DetachLoopNoFollow disassociates the loop device from its backing file.
+func DetachLoopNoFollow(device *File) error {
+	loop, err := os.OpenFile(device.SafePath(), os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open loop device %v: %w", device, err)
+	}
+	defer loop.Close()
+	if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0); err != nil {
+		return fmt.Errorf("failed to detach %v: %w", device, err)
+	}
+	return nil
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/sys/unix"
@@ -15,9 +20,36 @@ import (
 
 var (
 	mntNamespace string
-	cpuTime      uint64
-	memoryBytes  uint64
+	pidNamespace string
+	netNamespace string
+	ipcNamespace string
+	utsNamespace string
+	rootDir      string
+	targetPid    int
+	enterMount   bool
+	enterPid     bool
+	enterNet     bool
+	cpuTime      rlimit
+	memoryBytes  rlimit
+	nofile       rlimit
+	nproc        rlimit
+	fsize        rlimit
+	rlimits      []string
 	targetUser   string
+	groups       []int
+	noNewPrivs   bool
+	dropCaps     bool
+	keepCaps     []string
+	outputFormat string
+	verbosity    int
+	dryRun       bool
+	allowedRoot  string
+	oomScoreAdj  int
+	cpuset       string
+	nice         int
+	ionice       string
+	umask        string
+	metricsSock  string
 )
 
 func init() {
@@ -29,78 +61,249 @@ func main() {
 
 	rootCmd := &cobra.Command{
 		Use: "virt-chroot",
+		Long: `virt-chroot runs commands and file operations in specific namespaces.
+
+Exit codes:
+  1  other failures
+  2  invalid arguments or flags
+  3  path resolution failures, e.g. symlinks or missing paths
+  4  permission denied
+  5  namespace join failures`,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if outputFormat != "text" && outputFormat != "json" {
+				return usageError(fmt.Errorf("output format %s is not supported, must be text or json", outputFormat))
+			}
+			setupLogging(os.Stderr, verbosity, outputFormat == "json")
+			if metricsSock != "" {
+				connectMetrics(metricsSock)
+			}
+			if maxSymlinks < 0 {
+				return usageError(fmt.Errorf("--max-symlinks must not be negative"))
+			}
+
+			if targetPid > 0 {
+				// like nsenter -t, use the namespaces of the target process
+				if enterMount {
+					mntNamespace = targetNamespacePath(targetPid, "mnt")
+				}
+				if enterPid {
+					pidNamespace = targetNamespacePath(targetPid, "pid")
+				}
+				if enterNet {
+					netNamespace = targetNamespacePath(targetPid, "net")
+				}
+			} else if enterMount || enterPid || enterNet {
+				return usageError(fmt.Errorf("--enter-mount, --enter-pid and --enter-net require --target-pid"))
+			}
 
+			// Namespaces are always joined in the order mount, pid, network, ipc, uts.
+			var namespaces []namespace
 			if mntNamespace != "" {
 				// join the mount namespace of a process
-				fd, err := os.Open(mntNamespace)
+				namespaces = append(namespaces, namespace{"mount", mntNamespace, unix.CLONE_NEWNS})
+			}
+			if pidNamespace != "" {
+				// Joining a pid namespace only affects children created afterwards,
+				// the executed command itself stays in the current pid namespace.
+				namespaces = append(namespaces, namespace{"pid", pidNamespace, unix.CLONE_NEWPID})
+			}
+			if netNamespace != "" {
+				namespaces = append(namespaces, namespace{"network", netNamespace, unix.CLONE_NEWNET})
+			}
+			if ipcNamespace != "" {
+				namespaces = append(namespaces, namespace{"ipc", ipcNamespace, unix.CLONE_NEWIPC})
+			}
+			if utsNamespace != "" {
+				namespaces = append(namespaces, namespace{"uts", utsNamespace, unix.CLONE_NEWUTS})
+			}
+			if err := joinNamespaces(namespaces); err != nil {
+				return namespaceError(err)
+			}
+
+			// Change the root while still privileged. Users are looked up below
+			// the new root afterwards.
+			if rootDir != "" {
+				// Ensure that the new root is a real path, so that we can't be
+				// tricked into a different root via symlinks.
+				rootPath, err := NewPathNoFollow(rootDir)
 				if err != nil {
-					return fmt.Errorf("failed to open mount namespace: %v", err)
+					return pathError(fmt.Errorf("root directory invalid: %w", err))
 				}
-				defer fd.Close()
+				err = rootPath.ExecuteNoFollow(func(safePath string) error {
+					return syscall.Chroot(safePath)
+				})
+				if err != nil {
+					return fmt.Errorf("failed to change root: %w", err)
+				}
+				if err := unix.Chdir(pathRoot); err != nil {
+					return fmt.Errorf("failed to change to the new root: %w", err)
+				}
+				logger.Info("changed root", "root", rootPath.String())
+			}
 
-				if err = unix.Unshare(unix.CLONE_NEWNS); err != nil {
-					return fmt.Errorf("failed to detach from parent mount namespace: %v", err)
+			if chrootBase != "" {
+				if !filepath.IsAbs(chrootBase) || filepath.Clean(chrootBase) != chrootBase {
+					return usageError(fmt.Errorf("--chroot-base %q must be absolute and must not contain relative elements", chrootBase))
 				}
-				if err := unix.Setns(int(fd.Fd()), unix.CLONE_NEWNS); err != nil {
-					return fmt.Errorf("failed to join the mount namespace: %v", err)
+				if err := setChrootBase(); err != nil {
+					return err
+				}
+			}
+
+			// The allowed root is resolved like all other paths, after joining
+			// the namespaces and changing the root.
+			if allowedRoot != "" {
+				if err := setAllowedRoot(argPath(allowedRoot)); err != nil {
+					return err
 				}
 			}
 
 			// Looking up users needs resources, let's do it before we set rlimits.
-			var u *user.User
+			var uid, gid int
 			if targetUser != "" {
+				var numeric bool
 				var err error
-				u, err = user.Lookup(targetUser)
+				uid, gid, numeric, err = parseNumericUser(targetUser)
 				if err != nil {
-					return fmt.Errorf("failed to look up user: %v", err)
+					return usageError(fmt.Errorf("failed to parse user: %w", err))
+				}
+				if !numeric {
+					u, err := user.Lookup(targetUser)
+					if err != nil {
+						return fmt.Errorf("failed to look up user: %w", err)
+					}
+					uid, gid, err = userIDs(u)
+					if err != nil {
+						return err
+					}
+					if !cmd.Flags().Changed("groups") {
+						groups = userGroups(u)
+					}
 				}
 			}
 
-			if cpuTime > 0 {
-				value := &syscall.Rlimit{
-					Cur: cpuTime,
-					Max: cpuTime,
+			limits := []struct {
+				resource int
+				name     string
+				limit    *rlimit
+			}{
+				{unix.RLIMIT_CPU, "cpu time", &cpuTime},
+				{unix.RLIMIT_AS, "virtual memory", &memoryBytes},
+				{unix.RLIMIT_NOFILE, "open files", &nofile},
+				// The process count is accounted to the real uid, the limit is
+				// inherited across the uid switch below and applies to the target user.
+				{unix.RLIMIT_NPROC, "processes", &nproc},
+				{unix.RLIMIT_FSIZE, "file size", &fsize},
+			}
+			for _, l := range limits {
+				if !l.limit.isSet() {
+					continue
 				}
-				err := syscall.Setrlimit(unix.RLIMIT_CPU, value)
+				err := syscall.Setrlimit(l.resource, &l.limit.Rlimit)
 				if err != nil {
-					return fmt.Errorf("error setting prlimit on cpu time with value %d: %v", value, err)
+					return fmt.Errorf("error setting prlimit on %s with value %v: %w", l.name, l.limit, err)
 				}
+				logger.Info("set resource limit", "resource", l.name, "limit", l.limit.String())
 			}
 
-			if memoryBytes > 0 {
-				value := &syscall.Rlimit{
-					Cur: memoryBytes,
-					Max: memoryBytes,
+			for _, value := range rlimits {
+				resource, limit, err := parseNamedRlimit(value)
+				if err != nil {
+					return usageError(err)
 				}
-				err := syscall.Setrlimit(unix.RLIMIT_AS, value)
+				err = syscall.Setrlimit(resource, &limit)
 				if err != nil {
-					return fmt.Errorf("error setting prlimit on virtual memory with value %d: %v", value, err)
+					return fmt.Errorf("error setting prlimit %s: %w", value, err)
 				}
+				logger.Info("set resource limit", "rlimit", value)
 			}
 
-			// Now let's switch users and drop privileges
-			if u != nil {
-				uid, err := strconv.ParseInt(u.Uid, 10, 32)
+			// Lowering the score needs CAP_SYS_RESOURCE, set it while still privileged.
+			if cmd.Flags().Changed("oom-score-adj") {
+				if oomScoreAdj < -1000 || oomScoreAdj > 1000 {
+					return usageError(fmt.Errorf("--oom-score-adj must be between -1000 and 1000"))
+				}
+				err := os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(oomScoreAdj)), 0)
+				if errors.Is(err, os.ErrPermission) {
+					return fmt.Errorf("failed to set the oom score adjustment, lowering it requires CAP_SYS_RESOURCE: %w", err)
+				}
 				if err != nil {
-					return fmt.Errorf("failed to parse uid: %v", err)
+					return fmt.Errorf("failed to set the oom score adjustment: %w", err)
+				}
+				logger.Info("set oom score adjustment", "oomScoreAdj", oomScoreAdj)
+			}
+
+			// Applies to this locked thread, the executed command inherits it.
+			if cpuset != "" {
+				if err := setCPUAffinity(cpuset); err != nil {
+					return err
 				}
-				gid, err := strconv.ParseInt(u.Gid, 10, 32)
+				logger.Info("set cpu affinity", "cpuset", cpuset)
+			}
+			if cmd.Flags().Changed("nice") {
+				if err := setNice(nice); err != nil {
+					return err
+				}
+				logger.Info("set niceness", "nice", nice)
+			}
+			if ionice != "" {
+				if err := setIOPriority(ionice); err != nil {
+					return err
+				}
+				logger.Info("set io priority", "ionice", ionice)
+			}
+			// Set before anything is created, the executed command inherits it.
+			if umask != "" {
+				mask, err := strconv.ParseUint(umask, 8, 32)
+				if err != nil || mask > 0777 {
+					return usageError(fmt.Errorf("--umask %q must be an octal mode up to 0777", umask))
+				}
+				unix.Umask(int(mask))
+				logger.Info("set umask", "umask", fmt.Sprintf("%#o", mask))
+			}
+
+			// Has to be set from this thread, it is inherited by the executed command.
+			if noNewPrivs {
+				if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+					return fmt.Errorf("failed to set no_new_privs: %w", err)
+				}
+				logger.Info("set no_new_privs")
+			}
+
+			// Dropping capabilities from the bounding set needs CAP_SETPCAP, which
+			// is gone after switching to a non-root user, so this happens right
+			// before the switch. Don't move it after the setuid, PR_CAPBSET_DROP
+			// would fail with EPERM there.
+			if dropCaps || len(keepCaps) > 0 {
+				keep, err := parseCapabilities(keepCaps)
 				if err != nil {
-					return fmt.Errorf("failed to parse gid: %v", err)
+					return usageError(err)
+				}
+				if err := dropCapabilities(keep); err != nil {
+					return err
+				}
+				logger.Info("dropped capabilities from the bounding, inheritable and ambient sets", "keep", keepCaps)
+			}
+
+			// Now let's switch users and drop privileges
+			if targetUser != "" {
+				if len(groups) == 0 {
+					// fall back to only the primary group of the user
+					groups = []int{gid}
 				}
-				err = unix.Setgroups([]int{int(gid)})
+				err := unix.Setgroups(groups)
 				if err != nil {
-					return fmt.Errorf("failed to drop auxiliary groups: %v", err)
+					return fmt.Errorf("failed to set supplementary groups: %w", err)
 				}
 				_, _, errno := syscall.Syscall(syscall.SYS_SETGID, uintptr(gid), 0, 0)
 				if errno != 0 {
-					return fmt.Errorf("failed to join the group of the user: %v", err)
+					return fmt.Errorf("failed to join the group of the user: %w", errno)
 				}
 				_, _, errno = syscall.Syscall(syscall.SYS_SETUID, uintptr(uid), 0, 0)
 				if errno != 0 {
-					return fmt.Errorf("failed to switch to user: %v", err)
+					return fmt.Errorf("failed to switch to user: %w", errno)
 				}
+				logger.Info("switched user", "uid", uid, "gid", gid, "groups", groups)
 			}
 			return nil
 
@@ -110,102 +313,2011 @@ func main() {
 		},
 	}
 
-	rootCmd.PersistentFlags().Uint64Var(&cpuTime, "cpu", 0, "cpu time in seconds for the process")
-	rootCmd.PersistentFlags().Uint64Var(&memoryBytes, "memory", 0, "memory in bytes for the process")
+	rootCmd.PersistentFlags().Var(&cpuTime, "cpu", "cpu time in seconds for the process, as limit or soft:hard")
+	rootCmd.PersistentFlags().Var(&memoryBytes, "memory", "memory in bytes for the process, as limit or soft:hard")
+	rootCmd.PersistentFlags().Var(&nofile, "nofile", "maximum number of open file descriptors for the process, as limit or soft:hard")
+	rootCmd.PersistentFlags().Var(&nproc, "nproc", "maximum number of processes for the user the process runs as, as limit or soft:hard")
+	rootCmd.PersistentFlags().Var(&fsize, "fsize", "maximum size in bytes of files written by the process, as limit or soft:hard")
+	rootCmd.PersistentFlags().StringArrayVar(&rlimits, "rlimit", nil, "resource limit as NAME=limit or NAME=soft:hard, e.g. STACK=8388608, can be repeated")
 	rootCmd.PersistentFlags().StringVar(&mntNamespace, "mount", "", "mount namespace to use")
-	rootCmd.PersistentFlags().StringVar(&targetUser, "user", "", "switch to this targetUser to e.g. drop privileges")
+	rootCmd.PersistentFlags().StringVar(&pidNamespace, "pid", "", "pid namespace to use for children of the executed command")
+	rootCmd.PersistentFlags().StringVar(&netNamespace, "net", "", "network namespace to use")
+	rootCmd.PersistentFlags().StringVar(&ipcNamespace, "ipc", "", "ipc namespace to use")
+	rootCmd.PersistentFlags().StringVar(&utsNamespace, "uts", "", "uts namespace to use")
+	rootCmd.PersistentFlags().IntVar(&targetPid, "target-pid", 0, "process whose namespaces are joined with --enter-mount, --enter-pid and --enter-net")
+	rootCmd.PersistentFlags().BoolVar(&enterMount, "enter-mount", false, "join the mount namespace of --target-pid")
+	rootCmd.PersistentFlags().BoolVar(&enterPid, "enter-pid", false, "join the pid namespace of --target-pid")
+	rootCmd.PersistentFlags().BoolVar(&enterNet, "enter-net", false, "join the network namespace of --target-pid")
+	rootCmd.MarkFlagsMutuallyExclusive("mount", "enter-mount")
+	rootCmd.MarkFlagsMutuallyExclusive("pid", "enter-pid")
+	rootCmd.MarkFlagsMutuallyExclusive("net", "enter-net")
+	rootCmd.PersistentFlags().StringVar(&rootDir, "root", "", "change the root directory of the process before switching users")
+	rootCmd.PersistentFlags().StringVar(&targetUser, "user", "", "switch to this targetUser to e.g. drop privileges, given as name, uid or uid:gid")
+	rootCmd.PersistentFlags().IntVar(&oomScoreAdj, "oom-score-adj", 0, "oom score adjustment of the process between -1000 and 1000, higher values are killed first")
+	rootCmd.PersistentFlags().StringVar(&cpuset, "cpuset", "", "pin the process to this list of online cpus, e.g. 0-3,7")
+	rootCmd.PersistentFlags().IntVar(&nice, "nice", 0, "niceness of the process between -20 and 19, lower values are scheduled first")
+	rootCmd.PersistentFlags().StringVar(&ionice, "ionice", "", "io scheduling class and level of the process as CLASS:LEVEL, e.g. best-effort:7 or idle")
+	rootCmd.PersistentFlags().StringVar(&umask, "umask", "", "octal umask of the process, e.g. 022, the --mode of create, mkdir and mknod is applied exactly regardless, it affects cp without --preserve and the executed command")
+	rootCmd.PersistentFlags().StringVar(&metricsSock, "metrics-socket", "", "best effort: write a JSON record with the duration and result of the operation to this unix socket, exec without --timeout reports nothing")
+	rootCmd.PersistentFlags().BoolVar(&noNewPrivs, "no-new-privs", false, "prevent the process from gaining privileges, e.g. through setuid binaries")
+	rootCmd.PersistentFlags().BoolVar(&dropCaps, "drop-caps", false, "drop all capabilities not listed in --keep-caps from the bounding and inheritable sets and clear the ambient set")
+	rootCmd.PersistentFlags().StringSliceVar(&keepCaps, "keep-caps", nil, "comma separated list of capabilities to keep in the bounding and inheritable sets, implies --drop-caps")
+	rootCmd.PersistentFlags().IntVar(&maxSymlinks, "max-symlinks", maxSymlinks, "maximum number of symlinks followed when resolving paths with --follow")
+	rootCmd.PersistentFlags().StringVar(&chrootBase, "chroot-base", "", "directory the path arguments are relative to, resolved after joining the namespaces and changing the root")
+	rootCmd.PersistentFlags().StringVar(&allowedRoot, "allowed-root", "", "refuse to operate on paths which don't resolve to a location below this directory, list-mounts only lists the mounts below it")
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "resolve paths and parse options of mount and umount, but print the mount operation instead of performing it")
+	rootCmd.PersistentFlags().CountVarP(&verbosity, "verbose", "v", "log the steps taken to stderr, repeat for debug output")
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "output", "text", "format of errors on stderr and of the version subcommand, text or json")
+	rootCmd.PersistentFlags().IntSliceVar(&groups, "groups", nil, "comma separated list of supplementary gids for --user, defaults to the groups of the user")
 
+	var execCPUTime, execMemoryBytes rlimit
 	execCmd := &cobra.Command{
 		Use:   "exec",
 		Short: "execute a sandboxed command in a specific mount namespace",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			err := syscall.Exec(args[0], args, os.Environ())
+			if workdir := cmd.Flag("workdir").Value.String(); workdir != "" {
+				// Ensure that the working directory is a real path, so that we
+				// can't be tricked into a different directory via symlinks.
+				workdirPath, err := NewPathNoFollow(argPath(workdir))
+				if err != nil {
+					return pathError(fmt.Errorf("working directory invalid: %w", err))
+				}
+				err = workdirPath.ExecuteNoFollow(func(safePath string) error {
+					return unix.Chdir(safePath)
+				})
+				if err != nil {
+					return fmt.Errorf("failed to change to working directory: %w", err)
+				}
+			}
+
+			// Override the persistent limits only for the command, after they
+			// were applied and the user was switched.
+			for _, l := range []struct {
+				resource int
+				name     string
+				limit    *rlimit
+			}{
+				{unix.RLIMIT_CPU, "cpu time", &execCPUTime},
+				{unix.RLIMIT_AS, "virtual memory", &execMemoryBytes},
+			} {
+				if !l.limit.isSet() {
+					continue
+				}
+				err := syscall.Setrlimit(l.resource, &l.limit.Rlimit)
+				if errors.Is(err, syscall.EPERM) {
+					return fmt.Errorf("error setting prlimit on %s with value %v, raising the hard limit requires CAP_SYS_RESOURCE: %w", l.name, l.limit, err)
+				}
+				if err != nil {
+					return fmt.Errorf("error setting prlimit on %s with value %v: %w", l.name, l.limit, err)
+				}
+				logger.Info("set resource limit of the command", "resource", l.name, "limit", l.limit.String())
+			}
+
+			clearEnv, err := cmd.Flags().GetBool("clear-env")
+			if err != nil {
+				return err
+			}
+			keepEnv, err := cmd.Flags().GetStringArray("keep-env")
+			if err != nil {
+				return err
+			}
+			setEnv, err := cmd.Flags().GetStringArray("env")
+			if err != nil {
+				return err
+			}
+			env, err := buildEnv(clearEnv, keepEnv, setEnv)
+			if err != nil {
+				return err
+			}
+
+			fds, err := cmd.Flags().GetIntSlice("keep-fd")
+			if err != nil {
+				return err
+			}
+			if err := keepFds(fds); err != nil {
+				return usageError(err)
+			}
+
+			timeout, err := cmd.Flags().GetDuration("timeout")
+			if err != nil {
+				return err
+			}
+			killAfter, err := cmd.Flags().GetDuration("kill-after")
+			if err != nil {
+				return err
+			}
+
+			// Without --timeout the command replaces this process and keeps
+			// its pid, so it is written before the seccomp filter is installed.
+			pidFile := cmd.Flag("pid-file").Value.String()
+			if pidFile != "" && timeout == 0 {
+				if err := writePidFile(pidFile, os.Getpid()); err != nil {
+					return err
+				}
+			}
+
+			seccompProfile := cmd.Flag("seccomp").Value.String()
+			if seccompProfile != "" && timeout > 0 {
+				// the filter would apply to waiting for the command as well
+				return usageError(fmt.Errorf("--seccomp can't be combined with --timeout"))
+			}
+			if seccompProfile != "" {
+				filter, err := loadSeccompFilter(seccompProfile)
+				if err != nil {
+					return err
+				}
+				// Installed as late as possible, nothing but the exec
+				// has to pass the filter anymore.
+				if err := installSeccompFilter(filter); err != nil {
+					return err
+				}
+			}
+			argv := args
+			if argv0 := cmd.Flag("argv0").Value.String(); argv0 != "" {
+				argv = append([]string{argv0}, args[1:]...)
+			}
+			if timeout > 0 {
+				var pidFileErr error
+				status, err := runWithTimeout(args[0], argv, env, timeout, killAfter, func(pid int) error {
+					if pidFile != "" {
+						pidFileErr = writePidFile(pidFile, pid)
+					}
+					return pidFileErr
+				})
+				if pidFileErr != nil {
+					return pidFileErr
+				}
+				if err != nil {
+					return fmt.Errorf("failed to execute command: %w", err)
+				}
+				if code := exitStatus(status); code != 0 {
+					// the command reported its failure already
+					cmd.SilenceErrors = true
+					cmd.SilenceUsage = true
+					return &commandExitError{code}
+				}
+				return nil
+			}
+			err = syscall.Exec(args[0], argv, env)
+			if err != nil {
+				return fmt.Errorf("failed to execute command: %w", err)
+			}
+			return nil
+		},
+	}
+
+	execCmd.Flags().String("seccomp", "", "seccomp profile to apply, either a built-in profile (deny-all-but-exec) or a path to a BPF program, implies --no-new-privs")
+
+	execCmd.Flags().Var(&execCPUTime, "exec-cpu", "cpu time in seconds for the command, as limit or soft:hard, overrides --cpu")
+	execCmd.Flags().Var(&execMemoryBytes, "exec-memory", "memory in bytes for the command, as limit or soft:hard, overrides --memory")
+	execCmd.Flags().StringP("workdir", "C", "", "working directory of the command")
+	execCmd.Flags().String("argv0", "", "argv[0] passed to the command instead of its path")
+	execCmd.Flags().Bool("clear-env", false, "start the command with an empty environment")
+	execCmd.Flags().StringArray("keep-env", nil, "pass only this variable of the environment to the command, can be repeated")
+	execCmd.Flags().StringArray("env", nil, "set the environment variable KEY=VALUE for the command, can be repeated")
+	execCmd.Flags().IntSlice("keep-fd", nil, "file descriptor passed on to the command, can be repeated")
+	execCmd.Flags().Duration("timeout", 0, "run the command as a child and terminate it with SIGTERM after this duration, e.g. 10m")
+	execCmd.Flags().String("pid-file", "", "write the pid of the command to this file, the child's pid with --timeout")
+	execCmd.Flags().Duration("kill-after", 10*time.Second, "send SIGKILL if the command is still running this long after the SIGTERM of --timeout")
+
+	runCmd := &cobra.Command{
+		Use:   "run [--bind source:target[:options]]... -- command [args]",
+		Short: "bind mount paths and execute a command in a specific mount namespace",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			specs, err := cmd.Flags().GetStringArray("bind")
+			if err != nil {
+				return err
+			}
+			// The source and target are closed once mounted, they must not
+			// be passed on to the command.
+			bind := func(spec string) error {
+				source, target, flags, err := parseBindSpec(spec)
+				if err != nil {
+					return usageError(err)
+				}
+				source, target = argPath(source), argPath(target)
+				// Resolved like the source and target of the mount
+				// subcommand and kept open until mounted.
+				sourceFile, err := NewFileNoFollow(source)
+				if err != nil {
+					return pathError(fmt.Errorf("mount source invalid: %w", err))
+				}
+				defer sourceFile.Close()
+				if err := checkAllowedFile(sourceFile); err != nil {
+					return err
+				}
+				targetFile, err := NewFileNoFollow(target)
+				if err != nil {
+					return pathError(fmt.Errorf("mount target invalid: %w", err))
+				}
+				defer targetFile.Close()
+				if err := checkAllowedFile(targetFile); err != nil {
+					return err
+				}
+				if err := checkBindTypes(sourceFile, targetFile); err != nil {
+					return err
+				}
+
+				logger.Info("mounting", "source", source, "sourceSafePath", sourceFile.SafePath(),
+					"target", targetFile.String(), "targetSafePath", targetFile.SafePath(),
+					"flags", fmt.Sprintf("%#x", flags))
+				if dryRun {
+					fmt.Fprintf(cmd.OutOrStdout(), "would bind mount %q on %q with flags %#x\n", source, target, flags)
+					return nil
+				}
+				if err := bindMount(sourceFile, targetFile, flags); err != nil {
+					return fmt.Errorf("failed to bind mount %s on %s: %w", source, target, err)
+				}
+				return nil
+			}
+			for _, spec := range specs {
+				if err := bind(spec); err != nil {
+					return err
+				}
+			}
+			if dryRun {
+				fmt.Fprintf(cmd.OutOrStdout(), "would execute %q\n", args)
+				return nil
+			}
+			err = syscall.Exec(args[0], args, os.Environ())
+			if err != nil {
+				return fmt.Errorf("failed to execute command: %w", err)
+			}
+			return nil
+		},
+	}
+	runCmd.Flags().StringArray("bind", nil, "bind mount source:target:options before executing the command, e.g. /data:/mnt:ro, can be repeated")
+
+	unshareCmd := &cobra.Command{
+		Use:   "unshare [--new-mount] [--new-pid] [--new-net] [--new-uts] [--new-ipc] -- command [args]",
+		Short: "execute a command in new namespaces",
+		Long: `Execute a command in newly created namespaces instead of joining existing ones.
+The global --mount, --pid, --net, --uts and --ipc flags join existing
+namespaces before the new ones are created.
+The mounts of a new mount namespace are made private recursively, so that
+mounts created in it don't propagate back to the original namespace.
+
+A new pid namespace only applies to children of the process creating it. With
+--new-pid the command is therefore run as a child, which becomes pid 1 of the new
+namespace, and virt-chroot waits for it and exits with its exit code.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var flags int
+			for _, ns := range []struct {
+				flag   string
+				nstype int
+			}{
+				{"new-mount", unix.CLONE_NEWNS},
+				{"new-pid", unix.CLONE_NEWPID},
+				{"new-net", unix.CLONE_NEWNET},
+				{"new-uts", unix.CLONE_NEWUTS},
+				{"new-ipc", unix.CLONE_NEWIPC},
+			} {
+				enabled, err := cmd.Flags().GetBool(ns.flag)
+				if err != nil {
+					return err
+				}
+				if enabled {
+					flags |= ns.nstype
+				}
+			}
+			if flags == 0 {
+				return usageError(fmt.Errorf("at least one of --new-mount, --new-pid, --new-net, --new-uts and --new-ipc is required"))
+			}
+
+			if err := unix.Unshare(flags); err != nil {
+				return namespaceError(fmt.Errorf("failed to create the namespaces: %w", err))
+			}
+			logger.Info("created namespaces", "flags", fmt.Sprintf("%#x", flags))
+			if flags&unix.CLONE_NEWNS != 0 {
+				if err := syscall.Mount("", pathRoot, "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+					return namespaceError(fmt.Errorf("failed to make the mounts of the new mount namespace private: %w", err))
+				}
+			}
+
+			if flags&unix.CLONE_NEWPID == 0 {
+				err := syscall.Exec(args[0], args, os.Environ())
+				if err != nil {
+					return fmt.Errorf("failed to execute command: %w", err)
+				}
+				return nil
+			}
+			status, err := runWithTimeout(args[0], args, os.Environ(), 0, 0, func(int) error { return nil })
 			if err != nil {
-				return fmt.Errorf("failed to execute command: %v", err)
+				return fmt.Errorf("failed to execute command: %w", err)
+			}
+			if code := exitStatus(status); code != 0 {
+				// the command reported its failure already
+				cmd.SilenceErrors = true
+				cmd.SilenceUsage = true
+				return &commandExitError{code}
 			}
 			return nil
 		},
 	}
+	unshareCmd.Flags().Bool("new-mount", false, "create a new mount namespace")
+	unshareCmd.Flags().Bool("new-pid", false, "create a new pid namespace, the command becomes its pid 1")
+	unshareCmd.Flags().Bool("new-net", false, "create a new network namespace")
+	unshareCmd.Flags().Bool("new-uts", false, "create a new uts namespace")
+	unshareCmd.Flags().Bool("new-ipc", false, "create a new ipc namespace")
 
 	mntCmd := &cobra.Command{
-		Use:   "mount",
+		Use:   "mount [source] target",
 		Short: "mount operations in a specific mount namespace",
-		Args:  cobra.MinimumNArgs(2),
+		Args:  cobra.RangeArgs(1, 2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			var mntOpts uint = 0
+			// with --source-fd the only argument is the target
+			useSourceFd := cmd.Flags().Changed("source-fd")
+			if useSourceFd && len(args) != 1 {
+				return usageError(fmt.Errorf("--source-fd replaces the mount source, only the target can be given"))
+			}
+			if !useSourceFd && len(args) != 2 {
+				return usageError(fmt.Errorf("accepts a source and a target, received %d arguments", len(args)))
+			}
+			source, target := "", argPath(args[len(args)-1])
+			if !useSourceFd {
+				source = argPath(args[0])
+			}
 
 			fsType := cmd.Flag("type").Value.String()
-			mntOptions := cmd.Flag("options").Value.String()
-			for _, opt := range strings.Split(mntOptions, ",") {
-				opt = strings.TrimSpace(opt)
-				switch opt {
-				case "ro":
-					mntOpts = mntOpts | syscall.MS_RDONLY
-				case "bind":
-					mntOpts = mntOpts | syscall.MS_BIND
-				default:
-					return fmt.Errorf("mount option %s is not supported", opt)
+			optionsMode := cmd.Flag("options-mode").Value.String()
+			if optionsMode != "auto" && optionsMode != "strict" {
+				return usageError(fmt.Errorf("--options-mode must be auto or strict, got %q", optionsMode))
+			}
+			mntOpts, optsData, err := parseMountOptionsData(cmd.Flag("options").Value.String(), optionsMode == "auto")
+			if err != nil {
+				return usageError(err)
+			}
+			if mntOpts&syscall.MS_MANDLOCK != 0 {
+				cmd.PrintErrln("warning: mandatory locking is deprecated and ignored since Linux 5.15")
+			}
+			// there is no filesystem to interpret the data of a bind mount
+			if optsData != "" && mntOpts&syscall.MS_BIND != 0 {
+				return usageError(fmt.Errorf("mount options %s are not supported for bind mounts", optsData))
+			}
+
+			// data is handed verbatim to the filesystem driver and is not
+			// interpreted as MS_* flags. Options which are not MS_* flags
+			// come first.
+			data := cmd.Flag("data").Value.String()
+			if optsData != "" {
+				data = strings.TrimSuffix(optsData+","+data, ",")
+			}
+			if data != "" {
+				if mntOpts&syscall.MS_BIND != 0 {
+					cmd.PrintErrln("warning: mount data is ignored for bind mounts")
+				} else if fsType == "" && mntOpts&syscall.MS_REMOUNT == 0 {
+					return usageError(fmt.Errorf("mount data requires a filesystem type"))
 				}
 			}
 
-			// Ensure that sourceFile is a real path. It will be kept open until used
-			// by the syscall via the file descriptor path in proc (SafePath) to ensure
-			// that no symlink injection can happen after the check.
-			sourceFile, err := NewFileNoFollow(args[0])
+			ifNotMounted, err := cmd.Flags().GetBool("if-not-mounted")
 			if err != nil {
-				return fmt.Errorf("mount source invalid: %v", err)
+				return err
+			}
+			newAPI, err := cmd.Flags().GetBool("new-api")
+			if err != nil {
+				return err
+			}
+			if newAPI && mntOpts&syscall.MS_REMOUNT != 0 {
+				return usageError(fmt.Errorf("--new-api can't be combined with remount"))
+			}
+			if newAPI && mntOpts&syscall.MS_BIND == 0 && fsType == "" {
+				return usageError(fmt.Errorf("--new-api requires a filesystem type"))
+			}
+			fdMount, err := cmd.Flags().GetBool("fd-mount")
+			if err != nil {
+				return err
+			}
+			if fdMount && (mntOpts&syscall.MS_BIND == 0 || mntOpts&syscall.MS_REMOUNT != 0) {
+				return usageError(fmt.Errorf("--fd-mount requires a bind mount"))
+			}
+			userns := cmd.Flag("userns").Value.String()
+			if userns != "" && (mntOpts&syscall.MS_BIND == 0 || mntOpts&syscall.MS_REMOUNT != 0) {
+				return usageError(fmt.Errorf("--userns requires a bind mount"))
+			}
+			if ifNotMounted && mntOpts&syscall.MS_REMOUNT != 0 {
+				return usageError(fmt.Errorf("--if-not-mounted can't be combined with remount"))
+			}
+			retries, err := cmd.Flags().GetInt("retry")
+			if err != nil {
+				return err
+			}
+			retryDelay, err := cmd.Flags().GetDuration("retry-delay")
+			if err != nil {
+				return err
+			}
+			if retries < 0 || retryDelay < 0 {
+				return usageError(fmt.Errorf("--retry and --retry-delay must not be negative"))
+			}
+			checkFsType, err := cmd.Flags().GetBool("check-fstype")
+			if err != nil {
+				return err
+			}
+			if checkFsType && fsType != "" && mntOpts&(syscall.MS_BIND|syscall.MS_REMOUNT) == 0 {
+				if err := checkFilesystemType(fsType); err != nil {
+					return err
+				}
+			}
+			verify, err := cmd.Flags().GetBool("verify")
+			if err != nil {
+				return err
+			}
+			makeTarget, err := cmd.Flags().GetBool("make-target")
+			if err != nil {
+				return err
+			}
+			if makeTarget && mntOpts&syscall.MS_REMOUNT != 0 {
+				return usageError(fmt.Errorf("--make-target can't be combined with remount"))
+			}
+			if useSourceFd && mntOpts&syscall.MS_REMOUNT != 0 {
+				return usageError(fmt.Errorf("--source-fd can't be combined with remount"))
+			}
+
+			// The kernel ignores the source on a remount, so only resolve it
+			// when it is actually used.
+			var sourceFile *File
+			var sourcePath string
+			if useSourceFd {
+				// The inherited file descriptor was resolved by the caller and is used
+				// via its file descriptor path in proc (SafePath) as well.
+				sourceFd, err := cmd.Flags().GetInt("source-fd")
+				if err != nil {
+					return err
+				}
+				sourceFile, err = NewFileFromFd(sourceFd)
+				if err != nil {
+					return usageError(fmt.Errorf("mount source invalid: %w", err))
+				}
+				defer sourceFile.Close()
+				source = UnsafeAbsolute(sourceFile.Path().Raw())
+			} else if mntOpts&syscall.MS_REMOUNT == 0 {
+				// Ensure that sourceFile is a real path. It will be kept open until used
+				// by the syscall via the file descriptor path in proc (SafePath) to ensure
+				// that no symlink injection can happen after the check.
+				sourceFile, err = NewFileNoFollow(source)
+				if err != nil {
+					return pathError(fmt.Errorf("mount source invalid: %w", err))
+				}
+				defer sourceFile.Close()
+			}
+			if sourceFile != nil {
+				if err := checkAllowedFile(sourceFile); err != nil {
+					return err
+				}
+				sourcePath = sourceFile.SafePath()
+			}
+
+			// The target has to exist before it is resolved. Bind mounts need
+			// one of the same kind as the source, e.g. an empty file to bind
+			// mount a single file on.
+			if makeTarget && !dryRun {
+				if err := makeMountTarget(sourceFile, mntOpts&syscall.MS_BIND != 0, target); err != nil {
+					return err
+				}
 			}
-			defer sourceFile.Close()
 
 			// Ensure that targetFile is a real path. It will be kept open until used
 			// by the syscall via the file descriptor path in proc (SafePath) to ensure
 			// that no symlink injection can happen after the check.
-			targetFile, err := NewFileNoFollow(args[1])
+			targetFile, err := NewFileNoFollow(target)
 			if err != nil {
-				return fmt.Errorf("mount target invalid: %v", err)
+				return pathError(fmt.Errorf("mount target invalid: %w", err))
 			}
 			defer targetFile.Close()
+			if err := checkAllowedFile(targetFile); err != nil {
+				return err
+			}
+			if mntOpts&syscall.MS_BIND != 0 && mntOpts&syscall.MS_REMOUNT == 0 {
+				if err := checkBindTypes(sourceFile, targetFile); err != nil {
+					return err
+				}
+			}
+
+			if ifNotMounted {
+				mounted, err := isMounted(sourceFile, targetFile, fsType, mntOpts)
+				if err != nil {
+					return fmt.Errorf("checking for an existing mount failed: %w", err)
+				}
+				if mounted {
+					logger.Info("already mounted", "source", source, "target", targetFile.String())
+					if verify {
+						if err := verifyMount(targetFile, mntOpts); err != nil {
+							return fmt.Errorf("mount verification failed: %w", err)
+						}
+					}
+					return nil
+				}
+			}
+
+			var propagation string
+			var propagationFlags []uintptr
+			if reference := cmd.Flag("propagation-from").Value.String(); reference != "" {
+				if mntOpts&syscall.MS_BIND == 0 || mntOpts&syscall.MS_REMOUNT != 0 {
+					return usageError(fmt.Errorf("--propagation-from requires a bind mount"))
+				}
+				referencePath, err := NewPathNoFollow(argPath(reference))
+				if err != nil {
+					return pathError(fmt.Errorf("propagation reference invalid: %w", err))
+				}
+				if err := checkAllowedPath(referencePath); err != nil {
+					return err
+				}
+				if propagation, propagationFlags, err = mountPropagation(referencePath); err != nil {
+					return fmt.Errorf("reading the propagation of %s failed: %w", reference, err)
+				}
+			}
+
+			// Detach the tree from the propagation of the host first, so that
+			// the mount doesn't propagate back.
+			if rprivate := cmd.Flag("make-rprivate").Value.String(); rprivate != "" {
+				rprivatePath, err := NewPathNoFollow(argPath(rprivate))
+				if err != nil {
+					return pathError(fmt.Errorf("rprivate path invalid: %w", err))
+				}
+				if err := checkAllowedPath(rprivatePath); err != nil {
+					return err
+				}
+				err = rprivatePath.ExecuteNoFollow(func(safePath string) error {
+					logger.Info("making mounts private", "path", rprivatePath.String(), "safePath", safePath)
+					if dryRun {
+						realPath, err := os.Readlink(safePath)
+						if err != nil {
+							return err
+						}
+						fmt.Fprintf(cmd.OutOrStdout(), "would make the mounts below %q private\n", realPath)
+						return nil
+					}
+					return syscall.Mount("", safePath, "", syscall.MS_PRIVATE|syscall.MS_REC, "")
+				})
+				if err != nil {
+					return fmt.Errorf("changing propagation failed: %w", err)
+				}
+			}
 
-			return syscall.Mount(sourceFile.SafePath(), targetFile.SafePath(), fsType, uintptr(mntOpts), "")
+			logger.Info("mounting", "source", source, "sourceSafePath", sourcePath,
+				"target", targetFile.String(), "targetSafePath", targetFile.SafePath(),
+				"type", fsType, "flags", fmt.Sprintf("%#x", mntOpts), "data", data)
+			if dryRun {
+				var source string
+				if sourcePath != "" {
+					if source, err = os.Readlink(sourcePath); err != nil {
+						return err
+					}
+				}
+				target, err := os.Readlink(targetFile.SafePath())
+				if err != nil {
+					return err
+				}
+				if userns != "" {
+					fmt.Fprintf(cmd.OutOrStdout(), "would bind mount %q on %q idmapped with user namespace %q and flags %#x\n", source, target, userns, mntOpts)
+					return nil
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "would mount %q on %q with type %q, flags %#x and data %q\n", source, target, fsType, mntOpts, data)
+				if propagation != "" {
+					fmt.Fprintf(cmd.OutOrStdout(), "would make the mount on %q %s\n", target, propagation)
+				}
+				return nil
+			}
+			var usernsFile *os.File
+			if userns != "" {
+				// the user namespace file is a symlink in proc, like the
+				// namespaces to join it is not resolved with NewFileNoFollow
+				usernsFile, err = os.Open(userns)
+				if err != nil {
+					return fmt.Errorf("failed to open user namespace: %w", err)
+				}
+				defer usernsFile.Close()
+			}
+			mount := func() error {
+				if usernsFile != nil {
+					return IdmappedBindMountNoFollow(sourceFile, targetFile, usernsFile, mntOpts)
+				}
+				var err error
+				legacy := true
+				if fdMount {
+					err = FdBindMountNoFollow(sourceFile, targetFile, mntOpts)
+					if legacy = errors.Is(err, syscall.ENOSYS); legacy {
+						logger.Info("open_tree and move_mount are not available, falling back to mount", "error", err)
+					}
+				} else if newAPI {
+					err = NewAPIMountNoFollow(sourceFile, targetFile, fsType, mntOpts, data)
+					if legacy = errors.Is(err, syscall.ENOSYS); legacy {
+						logger.Info("the new mount API is not available, falling back to mount", "error", err)
+					}
+				}
+				if legacy && mntOpts&syscall.MS_BIND != 0 && mntOpts&syscall.MS_REMOUNT == 0 {
+					err = bindMount(sourceFile, targetFile, mntOpts)
+				} else if legacy {
+					err = syscall.Mount(sourcePath, targetFile.SafePath(), fsType, mntOpts, data)
+				}
+				return err
+			}
+			if err := retryMount(mount, retries, retryDelay); err != nil {
+				if mntOpts&syscall.MS_MANDLOCK != 0 && errors.Is(err, syscall.EPERM) {
+					return fmt.Errorf("mandatory locking was rejected, the kernel is built without CONFIG_MANDATORY_FILE_LOCKING: %w", err)
+				}
+				return err
+			}
+			if propagationFlags != nil {
+				if err := setPropagation(targetFile, propagationFlags); err != nil {
+					return err
+				}
+				logger.Info("changed propagation", "target", targetFile.String(), "propagation", propagation)
+			}
+			if verify {
+				if err := verifyMount(targetFile, mntOpts); err != nil {
+					return fmt.Errorf("mount verification failed: %w", err)
+				}
+			}
+			return nil
 		},
 	}
-	mntCmd.Flags().StringP("options", "o", "", "comma separated list of mount options")
+	mntCmd.Flags().StringP("options", "o", "", "comma separated list of mount options, a comma can be escaped with a backslash")
 	mntCmd.Flags().StringP("type", "t", "", "fstype")
+	mntCmd.Flags().Int("source-fd", -1, "mount the file behind this inherited file descriptor instead of a source path")
+	mntCmd.Flags().Bool("new-api", false, "mount with fsopen, fsconfig, fsmount and move_mount if the kernel supports them")
+	mntCmd.Flags().Bool("fd-mount", false, "bind mount with open_tree and move_mount on the held file descriptors if the kernel supports them")
+	mntCmd.Flags().String("userns", "", "user namespace, e.g. /proc/<pid>/ns/user, whose id mapping is applied to a bind mount")
+	mntCmd.Flags().String("propagation-from", "", "give the bind mount the propagation type of the mount on this path")
+	mntCmd.Flags().String("make-rprivate", "", "recursively make the mounts at and below this path private before mounting")
+	mntCmd.Flags().Int("retry", 0, "retry the mount this many times if it fails with EBUSY or EAGAIN")
+	mntCmd.Flags().Duration("retry-delay", 100*time.Millisecond, "delay before the first retry of --retry, doubled for every further retry")
+	mntCmd.Flags().Bool("check-fstype", false, "fail early if the filesystem type is not listed in /proc/filesystems")
+	mntCmd.Flags().Bool("verify", false, "check in mountinfo that the mount on the target has the requested ro, nosuid, nodev and noexec flags")
+	mntCmd.Flags().Bool("make-target", false, "create the target if it does not exist, as an empty file for bind mounts of files and as a directory otherwise")
+	mntCmd.Flags().Bool("if-not-mounted", false, "do nothing if an equivalent mount already exists on the target, fail on a different one")
+	mntCmd.Flags().String("options-mode", "auto", "how to treat options which are not mount flags: auto passes them as mount data unless bind mounting, strict rejects them")
+	mntCmd.Flags().String("data", "", "filesystem specific mount data, passed verbatim to the kernel, commas within double quotes don't separate options")
 
-	umntCmd := &cobra.Command{
-		Use:   "umount",
-		Short: "unmount in a specific mount namespace",
-		Args:  cobra.MinimumNArgs(1),
+	overlayCmd := &cobra.Command{
+		Use:   "overlay",
+		Short: "mount an overlay filesystem in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Ensure that targetFile is a real path. It will be kept open until used
-			// by the syscall via the file descriptor path in proc (SafePath) to ensure
-			// that no symlink injection can happen after the check.
-			targetFile, err := NewPathNoFollow(args[0])
+			mntOpts, err := parseMountOptions(cmd.Flag("options").Value.String())
 			if err != nil {
-				return fmt.Errorf("mount target invalid: %v", err)
+				return usageError(err)
 			}
-			err = targetFile.ExecuteNoFollow(func(safePath string) error {
-				// we actively hold an open reference to the mount point,
-				// we have to lazy unmount, to not block ourselves
-				// with the active file-descriptor.
-				return syscall.Unmount(safePath, unix.MNT_DETACH)
-			})
-			if err != nil {
-				return fmt.Errorf("umount failed: %v", err)
+			if mntOpts&(syscall.MS_BIND|syscall.MS_REMOUNT) != 0 {
+				return usageError(fmt.Errorf("bind and remount are not supported for overlay mounts"))
+			}
+			lower := cmd.Flag("lower").Value.String()
+			if lower == "" {
+				return usageError(fmt.Errorf("at least one lower directory is required"))
 			}
-			return nil
-		},
-	}
 
-	rootCmd.AddCommand(
-		execCmd,
-		mntCmd,
-		umntCmd,
-	)
+			// Ensure that all directories are real paths. They are kept open
+			// and handed to the kernel via their file descriptor paths in proc
+			// (SafePath), so that no symlink injection can happen after the check.
+			var lowerDirs []*File
+			for _, dir := range strings.Split(lower, ":") {
+				lowerDir, err := NewFileNoFollow(argPath(dir))
+				if err != nil {
+					return pathError(fmt.Errorf("overlay lower directory invalid: %w", err))
+				}
+				defer lowerDir.Close()
+				if err := checkAllowedFile(lowerDir); err != nil {
+					return err
+				}
+				lowerDirs = append(lowerDirs, lowerDir)
+			}
+			var upperDir, workDir *File
+			if upper := cmd.Flag("upper").Value.String(); upper != "" {
+				upperDir, err = NewFileNoFollow(argPath(upper))
+				if err != nil {
+					return pathError(fmt.Errorf("overlay upper directory invalid: %w", err))
+				}
+				defer upperDir.Close()
+				if err := checkAllowedFile(upperDir); err != nil {
+					return err
+				}
+			}
+			if work := cmd.Flag("work").Value.String(); work != "" {
+				workDir, err = NewFileNoFollow(argPath(work))
+				if err != nil {
+					return pathError(fmt.Errorf("overlay work directory invalid: %w", err))
+				}
+				defer workDir.Close()
+				if err := checkAllowedFile(workDir); err != nil {
+					return err
+				}
+			}
+			data, err := overlayData(lowerDirs, upperDir, workDir)
+			if err != nil {
+				return usageError(err)
+			}
+
+			targetFile, err := NewFileNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("mount target invalid: %w", err))
+			}
+			defer targetFile.Close()
+			if err := checkAllowedFile(targetFile); err != nil {
+				return err
+			}
+
+			logger.Info("mounting overlay", "lower", lower, "upper", cmd.Flag("upper").Value.String(),
+				"work", cmd.Flag("work").Value.String(), "target", targetFile.String(),
+				"targetSafePath", targetFile.SafePath(), "flags", fmt.Sprintf("%#x", mntOpts), "data", data)
+			if dryRun {
+				target, err := os.Readlink(targetFile.SafePath())
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "would mount overlay on %q with flags %#x and data %q\n", target, mntOpts, data)
+				return nil
+			}
+			return syscall.Mount("overlay", targetFile.SafePath(), "overlay", mntOpts, data)
+		},
+	}
+	overlayCmd.Flags().String("lower", "", "colon separated list of lower directories, the uppermost first")
+	overlayCmd.Flags().String("upper", "", "upper directory receiving the changes, requires --work")
+	overlayCmd.Flags().String("work", "", "work directory on the same filesystem as --upper")
+	overlayCmd.Flags().StringP("options", "o", "", "comma separated list of mount options")
+
+	tmpfsCmd := &cobra.Command{
+		Use:   "tmpfs",
+		Short: "mount a tmpfs in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mntOpts, err := parseMountOptions(cmd.Flag("options").Value.String())
+			if err != nil {
+				return usageError(err)
+			}
+			if mntOpts&(syscall.MS_BIND|syscall.MS_REMOUNT) != 0 {
+				return usageError(fmt.Errorf("bind and remount are not supported for tmpfs mounts"))
+			}
+			data, err := tmpfsData(cmd.Flag("size").Value.String(), cmd.Flag("mode").Value.String())
+			if err != nil {
+				return usageError(err)
+			}
+
+			// Ensure that targetFile is a real path. It will be kept open until used
+			// by the syscall via the file descriptor path in proc (SafePath) to ensure
+			// that no symlink injection can happen after the check.
+			targetFile, err := NewFileNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("mount target invalid: %w", err))
+			}
+			defer targetFile.Close()
+			if err := checkAllowedFile(targetFile); err != nil {
+				return err
+			}
+
+			logger.Info("mounting tmpfs", "target", targetFile.String(), "targetSafePath", targetFile.SafePath(),
+				"flags", fmt.Sprintf("%#x", mntOpts), "data", data)
+			if dryRun {
+				target, err := os.Readlink(targetFile.SafePath())
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "would mount tmpfs on %q with flags %#x and data %q\n", target, mntOpts, data)
+				return nil
+			}
+			return syscall.Mount("tmpfs", targetFile.SafePath(), "tmpfs", mntOpts, data)
+		},
+	}
+	tmpfsCmd.Flags().String("size", "", "maximum size in bytes with an optional suffix, e.g. 64Mi, or in percent of the memory, e.g. 50%")
+	tmpfsCmd.Flags().String("mode", "", "octal mode of the root directory, e.g. 1777")
+	tmpfsCmd.Flags().StringP("options", "o", "", "comma separated list of mount options")
+
+	umntCmd := &cobra.Command{
+		Use:   "umount",
+		Short: "unmount in a specific mount namespace",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Ensure that targetFile is a real path. It will be kept open until used
+			// by the syscall via the file descriptor path in proc (SafePath) to ensure
+			// that no symlink injection can happen after the check.
+			targetFile, err := NewPathNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("mount target invalid: %w", err))
+			}
+			if err := checkAllowedPath(targetFile); err != nil {
+				return err
+			}
+			force, err := cmd.Flags().GetBool("force")
+			if err != nil {
+				return err
+			}
+			noLazy, err := cmd.Flags().GetBool("no-lazy")
+			if err != nil {
+				return err
+			}
+			recursive, err := cmd.Flags().GetBool("recursive")
+			if err != nil {
+				return err
+			}
+			ifMounted, err := cmd.Flags().GetBool("if-mounted")
+			if err != nil {
+				return err
+			}
+			// a recursive unmount already skips mounts which don't exist
+			if ifMounted && !recursive {
+				mounted, err := isMountPoint(targetFile)
+				if err != nil {
+					return fmt.Errorf("checking for a mount failed: %w", err)
+				}
+				if !mounted {
+					logger.Info("not mounted", "target", targetFile.String())
+					return nil
+				}
+			}
+			umntFlags := 0
+			if !noLazy {
+				umntFlags = umntFlags | unix.MNT_DETACH
+			}
+			if force {
+				umntFlags = umntFlags | unix.MNT_FORCE
+			}
+			if recursive {
+				err = unmountRecursive(cmd.OutOrStdout(), targetFile, umntFlags)
+			} else {
+				err = unmount(cmd.OutOrStdout(), targetFile, umntFlags)
+			}
+			if err != nil {
+				return fmt.Errorf("umount failed: %w", err)
+			}
+			return nil
+		},
+	}
+
+	umntCmd.Flags().Bool("force", false, "force the unmount, e.g. of unreachable NFS or FUSE mounts")
+	umntCmd.Flags().Bool("no-lazy", false, "do not detach the mount lazily")
+	umntCmd.Flags().BoolP("recursive", "R", false, "unmount all mounts at or below the target, deepest first")
+	umntCmd.Flags().Bool("if-mounted", false, "do nothing if the target is not a mount point")
+
+	propagationCmd := &cobra.Command{
+		Use:   "propagation",
+		Short: "change the propagation type of a mount in a specific mount namespace",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var propagation uintptr
+			switch args[0] {
+			case "private":
+				propagation = syscall.MS_PRIVATE
+			case "shared":
+				propagation = syscall.MS_SHARED
+			case "slave":
+				propagation = syscall.MS_SLAVE
+			case "unbindable":
+				propagation = syscall.MS_UNBINDABLE
+			default:
+				return usageError(fmt.Errorf("propagation type %s is not supported", args[0]))
+			}
+			recursive, err := cmd.Flags().GetBool("recursive")
+			if err != nil {
+				return err
+			}
+			if recursive {
+				propagation = propagation | syscall.MS_REC
+			}
+
+			// Ensure that targetFile is a real path. It will be kept open until used
+			// by the syscall via the file descriptor path in proc (SafePath) to ensure
+			// that no symlink injection can happen after the check.
+			targetFile, err := NewPathNoFollow(argPath(args[1]))
+			if err != nil {
+				return pathError(fmt.Errorf("mount target invalid: %w", err))
+			}
+			if err := checkAllowedPath(targetFile); err != nil {
+				return err
+			}
+			err = targetFile.ExecuteNoFollow(func(safePath string) error {
+				return syscall.Mount("", safePath, "", propagation, "")
+			})
+			if err != nil {
+				return fmt.Errorf("changing propagation failed: %w", err)
+			}
+			return nil
+		},
+	}
+	propagationCmd.Flags().BoolP("recursive", "r", false, "apply the propagation type to all submounts")
+
+	moveCmd := &cobra.Command{
+		Use:   "move",
+		Short: "move a mount to a different mount point in a specific mount namespace",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Ensure that source and target are real paths. They will be kept open until used
+			// by the syscall via the file descriptor path in proc (SafePath) to ensure
+			// that no symlink injection can happen after the check.
+			sourcePath, err := NewPathNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("move source invalid: %w", err))
+			}
+			if err := checkAllowedPath(sourcePath); err != nil {
+				return err
+			}
+			targetPath, err := NewPathNoFollow(argPath(args[1]))
+			if err != nil {
+				return pathError(fmt.Errorf("move target invalid: %w", err))
+			}
+			if err := checkAllowedPath(targetPath); err != nil {
+				return err
+			}
+			err = sourcePath.ExecuteNoFollow(func(safeSource string) error {
+				return targetPath.ExecuteNoFollow(func(safeTarget string) error {
+					info, err := os.Stat(safeTarget)
+					if err != nil {
+						return err
+					}
+					if !info.IsDir() {
+						return fmt.Errorf("target %s is not a directory", args[1])
+					}
+					err = syscall.Mount(safeSource, safeTarget, "", syscall.MS_MOVE, "")
+					if errors.Is(err, syscall.EINVAL) {
+						return fmt.Errorf("%w: source is not a mount point or the mount it resides on has shared propagation", err)
+					}
+					return err
+				})
+			})
+			if err != nil {
+				return fmt.Errorf("move failed: %w", err)
+			}
+			return nil
+		},
+	}
+
+	pivotRootCmd := &cobra.Command{
+		Use:   "pivot-root",
+		Short: "change the root mount in a specific mount namespace",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ensureMount, err := cmd.Flags().GetBool("ensure-mount")
+			if err != nil {
+				return err
+			}
+			if ensureMount {
+				// pivot_root requires the new root to be a mount point, bind
+				// mount it onto itself to turn it into one.
+				newRootPath, err := NewPathNoFollow(argPath(args[0]))
+				if err != nil {
+					return pathError(fmt.Errorf("new root invalid: %w", err))
+				}
+				if err := checkAllowedPath(newRootPath); err != nil {
+					return err
+				}
+				err = newRootPath.ExecuteNoFollow(func(safePath string) error {
+					return syscall.Mount(safePath, safePath, "", syscall.MS_BIND|syscall.MS_REC, "")
+				})
+				if err != nil {
+					return fmt.Errorf("failed to bind mount new root: %w", err)
+				}
+			}
+
+			// Resolve both paths only after the optional bind mount, so that
+			// they refer to the new mount and not to the directory below it.
+			newRootPath, err := NewPathNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("new root invalid: %w", err))
+			}
+			if err := checkAllowedPath(newRootPath); err != nil {
+				return err
+			}
+			putOldPath, err := NewPathNoFollow(argPath(args[1]))
+			if err != nil {
+				return pathError(fmt.Errorf("put old invalid: %w", err))
+			}
+			if err := checkAllowedPath(putOldPath); err != nil {
+				return err
+			}
+			err = newRootPath.ExecuteNoFollow(func(safeNewRoot string) error {
+				return putOldPath.ExecuteNoFollow(func(safePutOld string) error {
+					err := unix.PivotRoot(safeNewRoot, safePutOld)
+					if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EBUSY) {
+						return fmt.Errorf("%w: new root is not a mount point, put old is not below new root or a mount involved has shared propagation", err)
+					}
+					return err
+				})
+			})
+			if err != nil {
+				return fmt.Errorf("pivot root failed: %w", err)
+			}
+			return unix.Chdir(pathRoot)
+		},
+	}
+	pivotRootCmd.Flags().Bool("ensure-mount", false, "bind mount the new root onto itself first to make it a mount point")
+
+	createCmd := &cobra.Command{
+		Use:   "create",
+		Short: "create an empty file in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mode, err := parseFileMode(cmd.Flag("mode").Value.String())
+			if err != nil {
+				return usageError(err)
+			}
+			uid, err := cmd.Flags().GetInt("uid")
+			if err != nil {
+				return err
+			}
+			gid, err := cmd.Flags().GetInt("gid")
+			if err != nil {
+				return err
+			}
+
+			// Ensure that the parent is a real path, the file is created relative
+			// to it and must not exist yet.
+			parent, name, err := NewParentNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("create target invalid: %w", err))
+			}
+			if err := checkAllowedChild(parent, name); err != nil {
+				return err
+			}
+			if err := TouchAtNoFollow(parent, name, mode.Perm()); err != nil {
+				return fmt.Errorf("create failed: %w", err)
+			}
+			file, err := JoinNoFollow(parent, name)
+			if err != nil {
+				return fmt.Errorf("create failed: %w", err)
+			}
+			// set the exact mode, independent of the umask
+			if err := ChpermAtNoFollow(file, uid, gid, mode); err != nil {
+				return fmt.Errorf("setting permissions failed: %w", err)
+			}
+			return nil
+		},
+	}
+	createCmd.Flags().String("mode", "0644", "octal file mode")
+	createCmd.Flags().Int("uid", -1, "owner of the file, -1 keeps the current user")
+	createCmd.Flags().Int("gid", -1, "group of the file, -1 keeps the current group")
+
+	mkdirCmd := &cobra.Command{
+		Use:   "mkdir",
+		Short: "create a directory in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mode, err := parseFileMode(cmd.Flag("mode").Value.String())
+			if err != nil {
+				return usageError(err)
+			}
+			parents, err := cmd.Flags().GetBool("parents")
+			if err != nil {
+				return err
+			}
+			if parents {
+				// no symlinks are followed while creating the directories,
+				// so the path is the real path
+				if err := checkAllowedRealPath(filepath.Clean(argPath(args[0]))); err != nil {
+					return err
+				}
+				if err := MkdirAllNoFollow(argPath(args[0]), mode); err != nil {
+					return fmt.Errorf("mkdir failed: %w", err)
+				}
+				return nil
+			}
+
+			// Ensure that the parent is a real path, the directory is created
+			// relative to it.
+			parent, name, err := NewParentNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("mkdir target invalid: %w", err))
+			}
+			if err := checkAllowedChild(parent, name); err != nil {
+				return err
+			}
+			if err := mkdirExact(parent, name, mode); err != nil {
+				return fmt.Errorf("mkdir failed: %w", err)
+			}
+			return nil
+		},
+	}
+	mkdirCmd.Flags().String("mode", "0755", "octal mode of created directories")
+	mkdirCmd.Flags().BoolP("parents", "p", false, "create missing parents, existing directories are no error")
+
+	rmCmd := &cobra.Command{
+		Use:   "rm",
+		Short: "remove a file or directory in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			recursive, err := cmd.Flags().GetBool("recursive")
+			if err != nil {
+				return err
+			}
+			// Ensure that the path is a real path, a symlink as final element
+			// is removed itself and not followed.
+			path, err := NewPathNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("rm target invalid: %w", err))
+			}
+			if err := checkAllowedPath(path); err != nil {
+				return err
+			}
+			if recursive {
+				err = RemoveAllNoFollow(path)
+			} else {
+				err = UnlinkAtNoFollow(path)
+			}
+			if err != nil {
+				return fmt.Errorf("rm failed: %w", err)
+			}
+			return nil
+		},
+	}
+	rmCmd.Flags().BoolP("recursive", "r", false, "remove directories and their content")
+
+	statCmd := &cobra.Command{
+		Use:   "stat",
+		Short: "print metadata of a file in a specific mount namespace as JSON",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			follow, err := cmd.Flags().GetBool("follow")
+			if err != nil {
+				return err
+			}
+			var path *Path
+			if follow {
+				// symlinks are resolved, but can't escape the root
+				path, err = JoinAndResolveWithRelativeRoot(argRoot(), args[0])
+			} else {
+				path, err = NewPathNoFollow(argPath(args[0]))
+			}
+			if err != nil {
+				return pathError(fmt.Errorf("stat target invalid: %w", err))
+			}
+			if err := checkAllowedPath(path); err != nil {
+				return err
+			}
+			// Stat the held file descriptor, so that the path can't be swapped
+			// in between the resolution and the stat.
+			f, err := OpenAtNoFollow(path)
+			if err != nil {
+				return fmt.Errorf("stat failed: %w", err)
+			}
+			defer f.Close()
+			info, err := FstatNoFollow(f)
+			if err != nil {
+				return fmt.Errorf("stat failed: %w", err)
+			}
+			return json.NewEncoder(cmd.OutOrStdout()).Encode(info)
+		},
+	}
+	statCmd.Flags().Bool("follow", false, "follow symlinks")
+
+	chmodCmd := &cobra.Command{
+		Use:   "chmod",
+		Short: "change the mode of a file in a specific mount namespace",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mode, err := parseFileMode(args[0])
+			if err != nil {
+				return usageError(err)
+			}
+			follow, err := cmd.Flags().GetBool("follow")
+			if err != nil {
+				return err
+			}
+			var path *Path
+			if follow {
+				// symlinks are resolved, but can't escape the root
+				path, err = JoinAndResolveWithRelativeRoot(argRoot(), args[1])
+			} else {
+				path, err = NewPathNoFollow(argPath(args[1]))
+			}
+			if err != nil {
+				return pathError(fmt.Errorf("chmod target invalid: %w", err))
+			}
+			if err := checkAllowedPath(path); err != nil {
+				return err
+			}
+			// Operate on the held file descriptor, so that the file can't be
+			// swapped with a symlink after the check.
+			f, err := OpenAtNoFollow(path)
+			if err != nil {
+				return fmt.Errorf("chmod failed: %w", err)
+			}
+			defer f.Close()
+			info, err := FstatNoFollow(f)
+			if err != nil {
+				return fmt.Errorf("chmod failed: %w", err)
+			}
+			if info.Type == "symlink" {
+				return fmt.Errorf("chmod target %s is a symlink", args[1])
+			}
+			if err := os.Chmod(f.SafePath(), mode); err != nil {
+				return fmt.Errorf("chmod failed: %w", err)
+			}
+			return nil
+		},
+	}
+	chmodCmd.Flags().Bool("follow", false, "follow symlinks")
+
+	chownCmd := &cobra.Command{
+		Use:   "chown",
+		Short: "change the ownership of a file in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			uid, err := cmd.Flags().GetInt("uid")
+			if err != nil {
+				return err
+			}
+			gid, err := cmd.Flags().GetInt("gid")
+			if err != nil {
+				return err
+			}
+			// Ensure that the parent is a real path, the ownership is changed
+			// relative to it without following a symlink as final element.
+			parent, name, err := NewParentNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("chown target invalid: %w", err))
+			}
+			if err := checkAllowedChild(parent, name); err != nil {
+				return err
+			}
+			if err := LchownAtNoFollow(parent, name, uid, gid); err != nil {
+				return fmt.Errorf("chown failed: %w", err)
+			}
+			return nil
+		},
+	}
+	chownCmd.Flags().Int("uid", -1, "new owner, -1 leaves the owner unchanged")
+	chownCmd.Flags().Int("gid", -1, "new group, -1 leaves the group unchanged")
+
+	mknodCmd := &cobra.Command{
+		Use:   "mknod",
+		Short: "create a device node in a specific mount namespace",
+		Args:  cobra.ExactArgs(4),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if targetUser != "" {
+				// the capability to create device nodes is gone after the user switch
+				return usageError(fmt.Errorf("mknod can't be combined with --user"))
+			}
+			var devType uint32
+			switch args[1] {
+			case "b":
+				devType = unix.S_IFBLK
+			case "c":
+				devType = unix.S_IFCHR
+			default:
+				return usageError(fmt.Errorf("device type %s is not supported, must be b or c", args[1]))
+			}
+			major, err := strconv.ParseUint(args[2], 10, 32)
+			if err != nil || major > 0xfff {
+				return usageError(fmt.Errorf("invalid major number %s", args[2]))
+			}
+			minor, err := strconv.ParseUint(args[3], 10, 32)
+			if err != nil || minor > 0xfffff {
+				return usageError(fmt.Errorf("invalid minor number %s", args[3]))
+			}
+			mode, err := parseFileMode(cmd.Flag("mode").Value.String())
+			if err != nil {
+				return usageError(err)
+			}
+
+			// Ensure that the parent is a real path, the node is created relative to it.
+			parent, name, err := NewParentNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("mknod target invalid: %w", err))
+			}
+			if err := checkAllowedChild(parent, name); err != nil {
+				return err
+			}
+			dev := unix.Mkdev(uint32(major), uint32(minor))
+			if err := MknodAtNoFollow(parent, name, os.FileMode(devType|uint32(mode.Perm())), dev); err != nil {
+				return fmt.Errorf("mknod failed: %w", err)
+			}
+			node, err := JoinNoFollow(parent, name)
+			if err != nil {
+				return fmt.Errorf("mknod failed: %w", err)
+			}
+			// set the exact mode, independent of the umask
+			if err := ChmodAtNoFollow(node, mode); err != nil {
+				return fmt.Errorf("setting permissions failed: %w", err)
+			}
+			return nil
+		},
+	}
+	mknodCmd.Flags().String("mode", "0660", "octal mode of the device node")
+
+	attachLoopCmd := &cobra.Command{
+		Use:   "attach-loop",
+		Short: "attach a file to a free loop device in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			readOnly, err := cmd.Flags().GetBool("read-only")
+			if err != nil {
+				return err
+			}
+			// Ensure that the backing file is a real path. It will be kept open until
+			// handed to the loop device to ensure that no symlink injection can happen.
+			backingFile, err := NewFileNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("backing file invalid: %w", err))
+			}
+			defer backingFile.Close()
+			if err := checkAllowedFile(backingFile); err != nil {
+				return err
+			}
+			device, err := AttachLoopNoFollow(backingFile, readOnly)
+			if err != nil {
+				return fmt.Errorf("attaching loop device failed: %w", err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), device)
+			return nil
+		},
+	}
+	attachLoopCmd.Flags().Bool("read-only", false, "attach the backing file read-only")
+
+	detachLoopCmd := &cobra.Command{
+		Use:   "detach-loop",
+		Short: "detach a loop device from its backing file in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			device, err := NewFileNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("loop device invalid: %w", err))
+			}
+			defer device.Close()
+			if err := checkAllowedFile(device); err != nil {
+				return err
+			}
+			if err := DetachLoopNoFollow(device); err != nil {
+				return fmt.Errorf("detaching loop device failed: %w", err)
+			}
+			return nil
+		},
+	}
+
+	truncateCmd := &cobra.Command{
+		Use:   "truncate",
+		Short: "create or resize a file in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			size, err := parseSize(cmd.Flag("size").Value.String())
+			if err != nil {
+				return usageError(err)
+			}
+			allocate, err := cmd.Flags().GetBool("allocate")
+			if err != nil {
+				return err
+			}
+
+			// Ensure that the parent is a real path, a missing file is created
+			// relative to it.
+			parent, name, err := NewParentNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("truncate target invalid: %w", err))
+			}
+			if err := checkAllowedChild(parent, name); err != nil {
+				return err
+			}
+			file, err := JoinNoFollow(parent, name)
+			if errors.Is(err, os.ErrNotExist) {
+				if err := TouchAtNoFollow(parent, name, 0644); err != nil {
+					return fmt.Errorf("truncate failed: %w", err)
+				}
+				file, err = JoinNoFollow(parent, name)
+			}
+			if err != nil {
+				return pathError(fmt.Errorf("truncate target invalid: %w", err))
+			}
+			if err := TruncateAtNoFollow(file, int64(size), allocate); err != nil {
+				return fmt.Errorf("truncate failed: %w", err)
+			}
+			return nil
+		},
+	}
+	truncateCmd.Flags().String("size", "", "size in bytes, optionally with a suffix like Gi or G")
+	truncateCmd.Flags().Bool("allocate", false, "allocate the space instead of creating a sparse file")
+	_ = truncateCmd.MarkFlagRequired("size")
+
+	symlinkCmd := &cobra.Command{
+		Use:   "symlink",
+		Short: "create a symlink in a specific mount namespace",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Ensure that the parent of the link is a real path, the link is
+			// created relative to it. The link target may point anywhere.
+			parent, name, err := NewParentNoFollow(argPath(args[1]))
+			if err != nil {
+				return pathError(fmt.Errorf("symlink path invalid: %w", err))
+			}
+			if err := checkAllowedChild(parent, name); err != nil {
+				return err
+			}
+			err = SymlinkAtNoFollow(args[0], parent, name)
+			if errors.Is(err, syscall.EEXIST) {
+				return fmt.Errorf("symlink failed: %s already exists", args[1])
+			}
+			if err != nil {
+				return fmt.Errorf("symlink failed: %w", err)
+			}
+			return nil
+		},
+	}
+
+	readlinkCmd := &cobra.Command{
+		Use:   "readlink",
+		Short: "print the target of a symlink in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Ensure that the parent is a real path, the link is read relative to it.
+			parent, name, err := NewParentNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("readlink path invalid: %w", err))
+			}
+			if err := checkAllowedChild(parent, name); err != nil {
+				return err
+			}
+			target, err := ReadlinkAtNoFollow(parent, name)
+			if errors.Is(err, syscall.EINVAL) {
+				return fmt.Errorf("readlink failed: %s is not a symlink", args[0])
+			}
+			if err != nil {
+				return fmt.Errorf("readlink failed: %w", err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), target)
+			return nil
+		},
+	}
+
+	var cpSource *os.File
+	cpCmd := &cobra.Command{
+		Use:   "cp",
+		Short: "copy a file from the host into a specific mount namespace",
+		Args:  cobra.ExactArgs(2),
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// The source is opened on the host, before joining any namespace,
+			// so it isn't below --chroot-base.
+			sourceFile, err := NewFileNoFollow(args[0])
+			if err != nil {
+				return pathError(fmt.Errorf("copy source invalid: %w", err))
+			}
+			defer sourceFile.Close()
+			info, err := FstatNoFollow(sourceFile)
+			if err != nil {
+				return pathError(fmt.Errorf("copy source invalid: %w", err))
+			}
+			if info.Type != "file" {
+				return fmt.Errorf("copy source %s is not a regular file", args[0])
+			}
+			cpSource, err = os.Open(sourceFile.SafePath())
+			if err != nil {
+				return fmt.Errorf("failed to open copy source: %w", err)
+			}
+			return rootCmd.PersistentPreRunE(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			defer cpSource.Close()
+			preserve, err := cmd.Flags().GetBool("preserve")
+			if err != nil {
+				return err
+			}
+			mode := os.FileMode(0644)
+			if preserve {
+				info, err := cpSource.Stat()
+				if err != nil {
+					return fmt.Errorf("copy failed: %w", err)
+				}
+				mode = info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+			}
+
+			// Ensure that the parent of the destination is a real path, the
+			// destination is replaced relative to it.
+			parent, name, err := NewParentNoFollow(argPath(args[1]))
+			if err != nil {
+				return pathError(fmt.Errorf("copy destination invalid: %w", err))
+			}
+			if err := checkAllowedChild(parent, name); err != nil {
+				return err
+			}
+			if err := WriteFileAtomicNoFollow(parent, name, cpSource, mode, preserve); err != nil {
+				return fmt.Errorf("copy failed: %w", err)
+			}
+			return nil
+		},
+	}
+	cpCmd.Flags().Bool("preserve", false, "preserve the mode of the source")
+
+	lsCmd := &cobra.Command{
+		Use:   "ls",
+		Short: "list a directory in a specific mount namespace as JSON",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			recursive, err := cmd.Flags().GetBool("recursive")
+			if err != nil {
+				return err
+			}
+			maxDepth, err := cmd.Flags().GetInt("max-depth")
+			if err != nil {
+				return err
+			}
+			if maxDepth < 1 {
+				return usageError(fmt.Errorf("max depth must be at least 1"))
+			}
+			depth := 1
+			if recursive {
+				depth = maxDepth
+			}
+			// Ensure that the directory is a real path, the entries are read
+			// from the held file descriptor.
+			dir, err := NewPathNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("ls target invalid: %w", err))
+			}
+			if err := checkAllowedPath(dir); err != nil {
+				return err
+			}
+			entries, err := ReadDirNoFollow(dir, depth)
+			if err != nil {
+				return fmt.Errorf("ls failed: %w", err)
+			}
+			return json.NewEncoder(cmd.OutOrStdout()).Encode(entries)
+		},
+	}
+	lsCmd.Flags().BoolP("recursive", "R", false, "list subdirectories recursively")
+	lsCmd.Flags().Int("max-depth", 8, "maximum number of directory levels listed with --recursive")
+
+	relabelCmd := &cobra.Command{
+		Use:   "relabel",
+		Short: "set the SELinux context of a file in a specific mount namespace",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			recursive, err := cmd.Flags().GetBool("recursive")
+			if err != nil {
+				return err
+			}
+			// Ensure that the parent is a real path, the context is set
+			// relative to it without following a symlink as final element.
+			parent, name, err := NewParentNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("relabel target invalid: %w", err))
+			}
+			if err := checkAllowedChild(parent, name); err != nil {
+				return err
+			}
+			if err := RelabelAtNoFollow(parent, name, args[1], recursive); err != nil {
+				return fmt.Errorf("relabel failed: %w", err)
+			}
+			return nil
+		},
+	}
+	relabelCmd.Flags().BoolP("recursive", "R", false, "relabel the whole subtree")
+
+	getxattrCmd := &cobra.Command{
+		Use:   "getxattr",
+		Short: "print an extended attribute of a file in a specific mount namespace",
+		Long: "print an extended attribute of a file in a specific mount namespace, values which aren't valid UTF-8 " +
+			"are printed base64 encoded with a " + xattrBase64Prefix + " prefix",
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			list, err := cmd.Flags().GetBool("list")
+			if err != nil {
+				return err
+			}
+			if list != (len(args) == 1) {
+				return usageError(fmt.Errorf("either an attribute name or --list is required"))
+			}
+			path, err := NewPathNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("getxattr target invalid: %w", err))
+			}
+			if err := checkAllowedPath(path); err != nil {
+				return err
+			}
+			if list {
+				names, err := ListxattrNoFollow(path)
+				if err != nil {
+					return fmt.Errorf("getxattr failed: %w", err)
+				}
+				for _, name := range names {
+					fmt.Fprintln(cmd.OutOrStdout(), name)
+				}
+				return nil
+			}
+			value, err := GetxattrRawNoFollow(path, args[1])
+			if err != nil {
+				return fmt.Errorf("getxattr failed: %w", err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), encodeXattrValue(value))
+			return nil
+		},
+	}
+	getxattrCmd.Flags().Bool("list", false, "list the names of all attributes")
+
+	setxattrCmd := &cobra.Command{
+		Use:   "setxattr",
+		Short: "set an extended attribute of a file in a specific mount namespace",
+		Long: "set an extended attribute of a file in a specific mount namespace, values with a " +
+			xattrBase64Prefix + " prefix are base64 decoded",
+		Args: cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			value, err := decodeXattrValue(args[2])
+			if err != nil {
+				return err
+			}
+			path, err := NewPathNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("setxattr target invalid: %w", err))
+			}
+			if err := checkAllowedPath(path); err != nil {
+				return err
+			}
+			if err := SetxattrNoFollow(path, args[1], value); err != nil {
+				return fmt.Errorf("setxattr failed: %w", err)
+			}
+			return nil
+		},
+	}
+
+	blockdevSizeCmd := &cobra.Command{
+		Use:   "blockdev-size",
+		Short: "print the size in bytes of a block device in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			human, err := cmd.Flags().GetBool("human")
+			if err != nil {
+				return err
+			}
+			device, err := NewFileNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("block device invalid: %w", err))
+			}
+			defer device.Close()
+			if err := checkAllowedFile(device); err != nil {
+				return err
+			}
+			size, err := BlockDeviceSizeNoFollow(device)
+			if err != nil {
+				return fmt.Errorf("blockdev-size failed: %w", err)
+			}
+			if human {
+				fmt.Fprintln(cmd.OutOrStdout(), formatSize(size))
+			} else {
+				fmt.Fprintln(cmd.OutOrStdout(), size)
+			}
+			return nil
+		},
+	}
+	blockdevSizeCmd.Flags().Bool("human", false, "print the size with a binary suffix, e.g. 1.5Gi")
+
+	syncCmd := &cobra.Command{
+		Use:   "sync",
+		Short: "flush a file or, without a path, all filesystems to disk in a specific mount namespace",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dataOnly, err := cmd.Flags().GetBool("data-only")
+			if err != nil {
+				return err
+			}
+			if len(args) == 0 {
+				if dataOnly {
+					return usageError(fmt.Errorf("--data-only requires a path"))
+				}
+				unix.Sync()
+				return nil
+			}
+			file, err := NewFileNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("sync target invalid: %w", err))
+			}
+			defer file.Close()
+			if err := checkAllowedFile(file); err != nil {
+				return err
+			}
+			if err := SyncNoFollow(file, dataOnly); err != nil {
+				return fmt.Errorf("sync failed: %w", err)
+			}
+			return nil
+		},
+	}
+	syncCmd.Flags().Bool("data-only", false, "only flush the data and the metadata needed to read it, like fdatasync")
+
+	listMountsCmd := &cobra.Command{
+		Use:   "list-mounts",
+		Short: "list the mounts of a specific mount namespace as JSON",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			under := cmd.Flag("under").Value.String()
+			var underPath string
+			if under != "" {
+				// Ensure that the filter is a real path, mount points are
+				// compared with the path of the resolved file descriptor.
+				path, err := NewPathNoFollow(argPath(under))
+				if err != nil {
+					return pathError(fmt.Errorf("filter path invalid: %w", err))
+				}
+				if underPath, err = RealPathNoFollow(path); err != nil {
+					return fmt.Errorf("list-mounts failed: %w", err)
+				}
+				if err := checkAllowedRealPath(underPath); err != nil {
+					return err
+				}
+			}
+			mounts, err := readMountInfo()
+			if err != nil {
+				return fmt.Errorf("list-mounts failed: %w", err)
+			}
+			entries := []MountEntry{}
+			for _, mount := range mounts {
+				if underPath != "" && !isBelow(underPath, mount.MountPoint) {
+					continue
+				}
+				// mounts outside of the allowed root are not revealed
+				if checkAllowedRealPath(mount.MountPoint) != nil {
+					continue
+				}
+				entries = append(entries, mount.Entry())
+			}
+			return json.NewEncoder(cmd.OutOrStdout()).Encode(entries)
+		},
+	}
+	listMountsCmd.Flags().String("under", "", "only list mounts at or below this path")
+
+	isMountPointCmd := &cobra.Command{
+		Use:   "is-mountpoint",
+		Short: "print whether a path is a mount point in a specific mount namespace, exit 1 if not",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			strict, err := cmd.Flags().GetBool("strict")
+			if err != nil {
+				return err
+			}
+			file, err := NewFileNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("is-mountpoint path invalid: %w", err))
+			}
+			defer file.Close()
+			if err := checkAllowedFile(file); err != nil {
+				return err
+			}
+			mounted, err := isMountPointByDevice(file)
+			if err != nil {
+				return fmt.Errorf("is-mountpoint failed: %w", err)
+			}
+			if !mounted && strict {
+				// bind mounts within a filesystem are only visible in mountinfo
+				if mounted, err = isMountPoint(file.Path()); err != nil {
+					return fmt.Errorf("is-mountpoint failed: %w", err)
+				}
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), mounted)
+			if !mounted {
+				cmd.SilenceErrors = true
+				cmd.SilenceUsage = true
+				return &commandExitError{exitFailure}
+			}
+			return nil
+		},
+	}
+	isMountPointCmd.Flags().Bool("strict", false, "also consult mountinfo, to detect bind mounts within the same filesystem")
+
+	waitMountCmd := &cobra.Command{
+		Use:   "wait-mount",
+		Short: "wait until a mount appears on a path in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			timeout, err := cmd.Flags().GetDuration("timeout")
+			if err != nil {
+				return err
+			}
+			interval, err := cmd.Flags().GetDuration("interval")
+			if err != nil {
+				return err
+			}
+			if interval <= 0 {
+				return usageError(fmt.Errorf("--interval must be positive"))
+			}
+			// Ensure that the target is a real path, mount points are
+			// compared with the path of the resolved file descriptor.
+			path, err := NewPathNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("wait-mount target invalid: %w", err))
+			}
+			if err := checkAllowedPath(path); err != nil {
+				return err
+			}
+			realPath, err := RealPathNoFollow(path)
+			if err != nil {
+				return fmt.Errorf("wait-mount failed: %w", err)
+			}
+			if err := waitForMount(realPath, timeout, interval); err != nil {
+				return fmt.Errorf("wait-mount failed: %w", err)
+			}
+			return nil
+		},
+	}
+	waitMountCmd.Flags().Duration("timeout", 30*time.Second, "give up if no mount appeared after this duration")
+	waitMountCmd.Flags().Duration("interval", 100*time.Millisecond, "time between checks of the mounts")
+
+	resolveCmd := &cobra.Command{
+		Use:   "resolve",
+		Short: "print the safe path a path resolves to in a specific mount namespace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			real, err := cmd.Flags().GetBool("real")
+			if err != nil {
+				return err
+			}
+			file, err := NewFileNoFollow(argPath(args[0]))
+			if err != nil {
+				return pathError(fmt.Errorf("resolve path invalid: %w", err))
+			}
+			defer file.Close()
+			if err := checkAllowedFile(file); err != nil {
+				return err
+			}
+			if !real {
+				fmt.Fprintln(cmd.OutOrStdout(), file.SafePath())
+				return nil
+			}
+			realPath, err := os.Readlink(file.SafePath())
+			if err != nil {
+				return fmt.Errorf("resolve failed: %w", err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), realPath)
+			return nil
+		},
+	}
+	resolveCmd.Flags().Bool("real", false, "print the path the file descriptor refers to instead of the file descriptor path")
+
+	batchCmd := &cobra.Command{
+		Use:   "batch",
+		Short: "run the commands read from stdin as JSON in a specific mount namespace",
+		Long: `Run a stream of commands within a single invocation, so that the namespaces
+are joined and the root is changed only once. Every line of stdin is a JSON
+object like {"args": ["mount", "-o", "bind", "/src", "/dst"]} holding the
+arguments of a subcommand and its own flags. Global flags apply to the whole
+batch and can't be given per command, exec, run, unshare and cp are not
+supported.
+
+A JSON result is written to stdout for every command. The batch stops at the
+first failing command unless --keep-going is set, and exits with the exit
+code of the first failure.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keepGoing, err := cmd.Flags().GetBool("keep-going")
+			if err != nil {
+				return err
+			}
+			decoder := json.NewDecoder(cmd.InOrStdin())
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			var firstErr error
+			for index := 0; ; index++ {
+				var request batchRequest
+				if err := decoder.Decode(&request); err == io.EOF {
+					break
+				} else if err != nil {
+					return usageError(fmt.Errorf("failed to read batch request %d: %w", index, err))
+				}
+				start := time.Now()
+				output, err := runBatchCommand(cmd.Root(), request.Args)
+				if len(request.Args) > 0 {
+					reportMetrics(cmd.Name()+" "+request.Args[0], start, err)
+				}
+				result := batchResult{Index: index, Args: request.Args, Output: output}
+				if err != nil {
+					result.Error = err.Error()
+					result.Exit = exitCode(err)
+					logger.Info("batch command failed", "index", index, "args", request.Args, "error", err)
+				}
+				if err := encoder.Encode(result); err != nil {
+					return fmt.Errorf("failed to write batch result: %w", err)
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if firstErr != nil && !keepGoing {
+					break
+				}
+			}
+			if firstErr != nil {
+				// the result of the command reported the error already
+				cmd.SilenceErrors = true
+				cmd.SilenceUsage = true
+				return &commandExitError{exitCode(firstErr)}
+			}
+			return nil
+		},
+	}
+	batchCmd.Flags().Bool("keep-going", false, "continue with the remaining commands after a command failed")
+
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "print the version and build metadata",
+		Args:  cobra.NoArgs,
+		// no namespaces are joined and no privileges are dropped to print the version
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info := versionInfo{version, gitCommit, buildDate}
+			switch outputFormat {
+			case "json":
+				return json.NewEncoder(cmd.OutOrStdout()).Encode(info)
+			case "text":
+				fmt.Fprintf(cmd.OutOrStdout(), "version: %s\ngit commit: %s\nbuild date: %s\n", info.Version, info.GitCommit, info.BuildDate)
+				return nil
+			default:
+				return usageError(fmt.Errorf("output format %s is not supported, must be text or json", outputFormat))
+			}
+		},
+	}
+
+	rootCmd.AddCommand(
+		execCmd,
+		runCmd,
+		unshareCmd,
+		mntCmd,
+		overlayCmd,
+		tmpfsCmd,
+		umntCmd,
+		propagationCmd,
+		moveCmd,
+		pivotRootCmd,
+		createCmd,
+		mkdirCmd,
+		rmCmd,
+		statCmd,
+		chmodCmd,
+		chownCmd,
+		mknodCmd,
+		attachLoopCmd,
+		detachLoopCmd,
+		truncateCmd,
+		symlinkCmd,
+		readlinkCmd,
+		cpCmd,
+		lsCmd,
+		relabelCmd,
+		getxattrCmd,
+		setxattrCmd,
+		blockdevSizeCmd,
+		syncCmd,
+		listMountsCmd,
+		isMountPointCmd,
+		waitMountCmd,
+		resolveCmd,
+		batchCmd,
+		versionCmd,
+	)
+
+	silenceForJSON := func() {
+		if outputFormat == "json" {
+			// the error is only reported as JSON
+			rootCmd.SilenceErrors = true
+			rootCmd.SilenceUsage = true
+		}
+	}
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		// flag errors are reported before the initializers run
+		silenceForJSON()
+		return usageError(err)
+	})
+	// Argument errors are reported before any pre run hook, wrap the
+	// validators of all commands to categorize them
+	for _, c := range rootCmd.Commands() {
+		if c.Args == nil {
+			continue
+		}
+		validateArgs := c.Args
+		c.Args = func(cmd *cobra.Command, args []string) error {
+			if err := validateArgs(cmd, args); err != nil {
+				return usageError(err)
+			}
+			return nil
+		}
+	}
+	cobra.OnInitialize(silenceForJSON)
 
-	if err := rootCmd.Execute(); err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	start := time.Now()
+	cmd, err := rootCmd.ExecuteC()
+	reportMetrics(cmd.Name(), start, err)
+	var commandExit *commandExitError
+	if errors.As(err, &commandExit) {
+		os.Exit(commandExit.code)
+	}
+	if err != nil {
+		if outputFormat == "json" {
+			writeJSONError(os.Stderr, cmd.Name(), err)
+		} else {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(exitCode(err))
 	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestMain runs the real command line when the test binary is started by
+// virtChroot, so that tests can run virt-chroot without building it first.
+func TestMain(m *testing.M) {
+	if os.Getenv("VIRT_CHROOT_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// virtChroot returns a command running virt-chroot with args.
+func virtChroot(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "VIRT_CHROOT_TEST_MAIN=1")
+	return cmd
+}
+
+// requireRoot skips tests which mount or create namespaces.
+func requireRoot(t *testing.T) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+}
+
+// runInMountNamespace runs the shell script in a new private mount namespace,
+// so that its mounts disappear with it. $VC runs virt-chroot within the
+// script. It returns the combined output of the script.
+func runInMountNamespace(t *testing.T, script string) (string, error) {
+	t.Helper()
+	requireRoot(t)
+	cmd := exec.Command("/bin/sh", "-e", "-c", script)
+	cmd.Env = append(os.Environ(), "VIRT_CHROOT_TEST_MAIN=1", "VC="+os.Args[0])
+	cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWNS}
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+// mustRunInMountNamespace is runInMountNamespace failing the test if the
+// script fails.
+func mustRunInMountNamespace(t *testing.T, script string) string {
+	t.Helper()
+	out, err := runInMountNamespace(t, script)
+	if err != nil {
+		t.Fatalf("script failed: %v\n%s", err, out)
+	}
+	return out
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// metricsTimeout bounds connecting and writing to the metrics socket, so
+// that a stuck collector never delays the operation.
+const metricsTimeout = 100 * time.Millisecond
+
+// metricsConn is the connection to the --metrics-socket or nil. It is
+// established before the namespaces are joined and the root is changed, so
+// that the socket path is resolved like the caller sees it.
+var metricsConn net.Conn
+
+// metricsRecord is written to the metrics socket after each operation.
+type metricsRecord struct {
+	Operation  string  `json:"operation"`
+	DurationMs float64 `json:"durationMs"`
+	Result     string  `json:"result"`
+	Exit       int     `json:"exit"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// connectMetrics connects to the unix socket at path, as datagram socket if
+// possible and as stream socket otherwise. Failures are only logged, metrics
+// are best effort.
+func connectMetrics(path string) {
+	conn, err := net.DialTimeout("unixgram", path, metricsTimeout)
+	if errors.Is(err, syscall.EPROTOTYPE) {
+		conn, err = net.DialTimeout("unix", path, metricsTimeout)
+	}
+	if err != nil {
+		logger.Info("metrics socket is not available", "path", path, "error", err)
+		return
+	}
+	metricsConn = conn
+}
+
+// reportMetrics writes the outcome of operation, which started at start, to
+// the metrics socket if connected. Failures are only logged.
+func reportMetrics(operation string, start time.Time, err error) {
+	if metricsConn == nil {
+		return
+	}
+	record := metricsRecord{
+		Operation:  operation,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		Result:     "success",
+	}
+	var commandExit *commandExitError
+	if errors.As(err, &commandExit) {
+		record.Result, record.Exit = "failure", commandExit.code
+	} else if err != nil {
+		record.Result, record.Exit, record.Error = "failure", exitCode(err), err.Error()
+	}
+	data, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		logger.Info("failed to encode metrics", "error", marshalErr)
+		return
+	}
+	_ = metricsConn.SetWriteDeadline(time.Now().Add(metricsTimeout))
+	if _, writeErr := metricsConn.Write(append(data, '\n')); writeErr != nil {
+		logger.Info("failed to write metrics", "error", writeErr)
+	}
+}
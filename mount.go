@@ -0,0 +1,754 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// atimeOptions are the mount options controlling atime updates. The kernel
+// does not reject combinations of them but silently lets strictatime take
+// precedence over noatime, and noatime over the relatime default, so at most
+// one of them may be passed.
+var atimeOptions = map[string]uintptr{
+	"noatime":     syscall.MS_NOATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+}
+
+// splitMountOptions splits a comma separated list of mount options. Like
+// the kernel does for mount data, commas within double quotes don't split,
+// e.g. in context="system_u:object_r:container_file_t:s0:c1,c2", and the
+// quotes are kept. With escapes a comma preceded by a backslash doesn't split
+// either and is kept without the backslash.
+func splitMountOptions(options string, escapes bool) []string {
+	var parts []string
+	var current strings.Builder
+	quoted := false
+	for i := 0; i < len(options); i++ {
+		c := options[i]
+		switch {
+		case escapes && c == '\\' && i+1 < len(options) && options[i+1] == ',':
+			current.WriteByte(',')
+			i++
+		case c == '"':
+			quoted = !quoted
+			current.WriteByte(c)
+		case c == ',' && !quoted:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	return append(parts, current.String())
+}
+
+// parseMountOptions translates a comma separated list of mount options
+// into the corresponding MS_* flags. Commas can be escaped with a backslash.
+func parseMountOptions(options string) (uintptr, error) {
+	mntOpts, _, err := parseMountOptionsData(options, false)
+	return mntOpts, err
+}
+
+// parseMountOptionsData is parseMountOptions but with passthrough options
+// that are not MS_* flags are returned as filesystem specific mount data,
+// e.g. errors=remount-ro for ext4, instead of being rejected.
+func parseMountOptionsData(options string, passthrough bool) (uintptr, string, error) {
+	var mntOpts uintptr
+	var atime string
+	var data []string
+	for _, opt := range splitMountOptions(options, true) {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		if flag, ok := atimeOptions[opt]; ok {
+			if atime != "" && atime != opt {
+				return 0, "", fmt.Errorf("mount options %s and %s are mutually exclusive, strictatime takes precedence over noatime and noatime over relatime", atime, opt)
+			}
+			atime = opt
+			mntOpts = mntOpts | flag
+			continue
+		}
+		switch opt {
+		case "ro":
+			mntOpts = mntOpts | syscall.MS_RDONLY
+		case "bind":
+			mntOpts = mntOpts | syscall.MS_BIND
+		case "rbind":
+			mntOpts = mntOpts | syscall.MS_BIND | syscall.MS_REC
+		case "nosuid":
+			mntOpts = mntOpts | syscall.MS_NOSUID
+		case "nodev":
+			mntOpts = mntOpts | syscall.MS_NODEV
+		case "noexec":
+			mntOpts = mntOpts | syscall.MS_NOEXEC
+		case "remount":
+			mntOpts = mntOpts | syscall.MS_REMOUNT
+		case "nodiratime":
+			mntOpts = mntOpts | syscall.MS_NODIRATIME
+		case "sync":
+			mntOpts = mntOpts | syscall.MS_SYNCHRONOUS
+		case "dirsync":
+			mntOpts = mntOpts | syscall.MS_DIRSYNC
+		case "mand":
+			mntOpts = mntOpts | syscall.MS_MANDLOCK
+		case "lazytime":
+			// only defers the timestamp writes, it combines with the atime options
+			mntOpts = mntOpts | unix.MS_LAZYTIME
+		case "nosymfollow":
+			// older kernels silently ignore the flag
+			if !kernelAtLeast(5, 10) {
+				return 0, "", fmt.Errorf("mount option nosymfollow requires Linux 5.10 or newer")
+			}
+			mntOpts = mntOpts | unix.MS_NOSYMFOLLOW
+		default:
+			if !passthrough {
+				return 0, "", fmt.Errorf("mount option %s is not supported", opt)
+			}
+			data = append(data, opt)
+		}
+	}
+	return mntOpts, strings.Join(data, ","), nil
+}
+
+// parseBindSpec parses a bind mount given as source:target or
+// source:target:options, e.g. /data:/mnt:ro,nosuid.
+func parseBindSpec(spec string) (source, target string, flags uintptr, err error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", "", 0, fmt.Errorf("bind mount %q must be source:target or source:target:options", spec)
+	}
+	if len(parts) == 3 {
+		if flags, err = parseMountOptions(parts[2]); err != nil {
+			return "", "", 0, err
+		}
+		if flags&syscall.MS_REMOUNT != 0 {
+			return "", "", 0, fmt.Errorf("bind mount %q can't be a remount", spec)
+		}
+	}
+	return parts[0], parts[1], flags | syscall.MS_BIND, nil
+}
+
+// onDemandFilesystems are filesystem types whose module the kernel loads on
+// the first mount, they are not listed in /proc/filesystems before.
+var onDemandFilesystems = map[string]bool{
+	"overlay":  true,
+	"fuse":     true,
+	"squashfs": true,
+	"erofs":    true,
+	"nfs":      true,
+	"nfs4":     true,
+}
+
+// checkFilesystemType ensures that the kernel supports the filesystem type
+// fsType according to /proc/filesystems. Subtypes like fuse.sshfs are checked
+// by their main type.
+func checkFilesystemType(fsType string) error {
+	name, _, _ := strings.Cut(fsType, ".")
+	if onDemandFilesystems[name] {
+		return nil
+	}
+	content, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return fmt.Errorf("failed to read the supported filesystems: %w", err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		// lines are the type, prefixed by nodev for virtual filesystems
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("filesystem type %s is not supported by the kernel, the module providing it may need to be loaded", fsType)
+}
+
+// kernelAtLeast reports whether the running kernel is at least version
+// major.minor. An unparsable release is treated as recent enough.
+func kernelAtLeast(major, minor int) bool {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return true
+	}
+	var kernelMajor, kernelMinor int
+	if _, err := fmt.Sscanf(unix.ByteSliceToString(uname.Release[:]), "%d.%d", &kernelMajor, &kernelMinor); err != nil {
+		return true
+	}
+	return kernelMajor > major || kernelMajor == major && kernelMinor >= minor
+}
+
+// mountFlagOptions are the per mount flags as they are listed in the mount
+// options of mountinfo.
+var mountFlagOptions = []struct {
+	flag   uintptr
+	option string
+}{
+	{syscall.MS_RDONLY, "ro"},
+	{syscall.MS_NOSUID, "nosuid"},
+	{syscall.MS_NODEV, "nodev"},
+	{syscall.MS_NOEXEC, "noexec"},
+	{unix.MS_NOSYMFOLLOW, "nosymfollow"},
+}
+
+// findMount returns the topmost mount on mountPoint or nil if mountPoint is
+// not a mount point.
+func findMount(mountPoint string) (*MountInfo, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	var top *MountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint != mountPoint {
+			continue
+		}
+		// stacked mounts are children of the mount they cover
+		if top == nil || mounts[i].ParentID == top.ID {
+			top = &mounts[i]
+		}
+	}
+	return top, nil
+}
+
+// isMountPoint reports whether a mount exists on path.
+func isMountPoint(path *Path) (bool, error) {
+	realPath, err := RealPathNoFollow(path)
+	if err != nil {
+		return false, err
+	}
+	mount, err := findMount(realPath)
+	return mount != nil, err
+}
+
+// isMountPointByDevice reports whether the held file is a mount point by
+// comparing its device and inode with those of its parent. Bind mounts of
+// the same filesystem share the device of the parent and are not detected.
+func isMountPointByDevice(file *File) (bool, error) {
+	var st, parentSt unix.Stat_t
+	if err := unix.Fstat(file.fd, &st); err != nil {
+		return false, fmt.Errorf("failed to stat %v: %w", file.Path(), err)
+	}
+	var parent *File
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		// .. of the root of a mount is the directory it is mounted on
+		fd, err := unix.Openat(file.fd, "..", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return false, fmt.Errorf("failed to open the parent of %v: %w", file.Path(), err)
+		}
+		parent = &File{fd: fd, path: file.Path()}
+	} else {
+		dir, err := file.Path().DirNoFollow()
+		if err != nil {
+			return false, err
+		}
+		if parent, err = OpenAtNoFollow(dir); err != nil {
+			return false, err
+		}
+	}
+	defer parent.Close()
+	if err := unix.Fstat(parent.fd, &parentSt); err != nil {
+		return false, fmt.Errorf("failed to stat the parent of %v: %w", file.Path(), err)
+	}
+	// the root directory is its own parent
+	return st.Dev != parentSt.Dev || st.Ino == parentSt.Ino, nil
+}
+
+// waitForMount polls mountinfo every interval until a mount exists on
+// mountPoint or timeout expired.
+func waitForMount(mountPoint string, timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		mount, err := findMount(mountPoint)
+		if err != nil {
+			return err
+		}
+		if mount != nil {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("no mount appeared on %s within %v", mountPoint, timeout)
+		}
+		logger.Debug("waiting for mount", "target", mountPoint)
+		time.Sleep(interval)
+	}
+}
+
+// isMounted reports whether an equivalent mount of source already exists on
+// target, with source being nil on remounts. A different mount on target is
+// an error. Bind mounts are equivalent if the target refers to the same file
+// as the source, other mounts if the filesystem type, the device of a block
+// device source and the per mount flags match.
+func isMounted(source, target *File, fsType string, flags uintptr) (bool, error) {
+	targetPath, err := os.Readlink(target.SafePath())
+	if err != nil {
+		return false, err
+	}
+	mount, err := findMount(targetPath)
+	if err != nil || mount == nil {
+		return false, err
+	}
+
+	if flags&syscall.MS_BIND != 0 {
+		// the target file descriptor refers to the root of the topmost mount
+		var sourceStat, targetStat unix.Stat_t
+		if err := unix.Fstat(source.fd, &sourceStat); err != nil {
+			return false, err
+		}
+		if err := unix.Fstat(target.fd, &targetStat); err != nil {
+			return false, err
+		}
+		if sourceStat.Dev != targetStat.Dev || sourceStat.Ino != targetStat.Ino {
+			return false, fmt.Errorf("%s is already mounted from a different source", targetPath)
+		}
+		// A bind mount inherits the flags of its source, only the requested
+		// ones have to be set.
+		options := map[string]bool{}
+		for _, option := range strings.Split(mount.Options, ",") {
+			options[option] = true
+		}
+		for _, f := range mountFlagOptions {
+			if flags&f.flag != 0 && !options[f.option] {
+				return false, fmt.Errorf("%s is already mounted with different options %s", targetPath, mount.Options)
+			}
+		}
+		for _, option := range []string{"noatime", "relatime"} {
+			if flags&atimeOptions[option] != 0 && !options[option] {
+				return false, fmt.Errorf("%s is already mounted with different options %s", targetPath, mount.Options)
+			}
+		}
+		if flags&syscall.MS_STRICTATIME != 0 && (options["noatime"] || options["relatime"]) ||
+			flags&syscall.MS_NODIRATIME != 0 && !options["nodiratime"] {
+			return false, fmt.Errorf("%s is already mounted with different options %s", targetPath, mount.Options)
+		}
+		return true, nil
+	}
+
+	if fsType != "" && mount.FSType != fsType {
+		return false, fmt.Errorf("%s is already mounted with filesystem type %s", targetPath, mount.FSType)
+	}
+	if source != nil {
+		var sourceStat unix.Stat_t
+		if err := unix.Fstat(source.fd, &sourceStat); err != nil {
+			return false, err
+		}
+		if sourceStat.Mode&unix.S_IFMT == unix.S_IFBLK &&
+			(int(unix.Major(sourceStat.Rdev)) != mount.Major || int(unix.Minor(sourceStat.Rdev)) != mount.Minor) {
+			return false, fmt.Errorf("%s is already mounted from device %d:%d", targetPath, mount.Major, mount.Minor)
+		}
+	}
+	options := map[string]bool{}
+	for _, option := range strings.Split(mount.Options, ",") {
+		options[option] = true
+	}
+	for _, f := range mountFlagOptions {
+		if (flags&f.flag != 0) != options[f.option] {
+			return false, fmt.Errorf("%s is already mounted with different options %s", targetPath, mount.Options)
+		}
+	}
+	for option, flag := range atimeOptions {
+		if flags&flag == 0 {
+			continue
+		}
+		// strictatime is not listed, it is the absence of the others
+		if option == "strictatime" && (options["noatime"] || options["relatime"]) ||
+			option != "strictatime" && !options[option] {
+			return false, fmt.Errorf("%s is already mounted with different options %s", targetPath, mount.Options)
+		}
+	}
+	if flags&syscall.MS_NODIRATIME != 0 && !options["nodiratime"] {
+		return false, fmt.Errorf("%s is already mounted with different options %s", targetPath, mount.Options)
+	}
+	return true, nil
+}
+
+// bindRemountFlags are the flags of a bind mount which mount(2) ignores when
+// creating the bind mount and which can only be applied by a remount.
+const bindRemountFlags = syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+	syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME | syscall.MS_STRICTATIME | unix.MS_NOSYMFOLLOW
+
+// stNoSymFollow is ST_NOSYMFOLLOW, which is not defined in x/sys yet.
+const stNoSymFollow = 0x2000
+
+// statfsMountFlags maps the per mount flags reported by statfs to MS_* flags.
+var statfsMountFlags = []struct {
+	st   int64
+	flag uintptr
+}{
+	{unix.ST_RDONLY, syscall.MS_RDONLY},
+	{unix.ST_NOSUID, syscall.MS_NOSUID},
+	{unix.ST_NODEV, syscall.MS_NODEV},
+	{unix.ST_NOEXEC, syscall.MS_NOEXEC},
+	{unix.ST_NOATIME, syscall.MS_NOATIME},
+	{unix.ST_NODIRATIME, syscall.MS_NODIRATIME},
+	{unix.ST_RELATIME, syscall.MS_RELATIME},
+	{stNoSymFollow, unix.MS_NOSYMFOLLOW},
+}
+
+// sourceMountFlags returns the per mount flags of the mount source is on.
+func sourceMountFlags(source *File) (uintptr, error) {
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(source.fd, &st); err != nil {
+		return 0, fmt.Errorf("failed to statfs %v: %w", source.Path(), err)
+	}
+	var flags uintptr
+	for _, f := range statfsMountFlags {
+		if int64(st.Flags)&f.st != 0 {
+			flags = flags | f.flag
+		}
+	}
+	// statfs has no flag for strictatime, it is the mode without the others.
+	// A remount without any atime flag would fall back to relatime.
+	if flags&(syscall.MS_NOATIME|syscall.MS_RELATIME) == 0 {
+		flags = flags | syscall.MS_STRICTATIME
+	}
+	return flags, nil
+}
+
+// bindMount bind mounts source on target with mount(2). The kernel ignores
+// per mount flags like ro when creating a bind mount, so if any are given a
+// second mount(2) with MS_REMOUNT|MS_BIND applies them to the new mount.
+// That remount clears every flag it isn't given, so the flags of the source
+// mount, e.g. nosuid, are kept like runc does. The requested atime flags
+// replace the inherited one.
+func bindMount(source, target *File, flags uintptr) error {
+	var remountFlags uintptr
+	if flags&bindRemountFlags != 0 {
+		inherited, err := sourceMountFlags(source)
+		if err != nil {
+			return err
+		}
+		if flags&(syscall.MS_NOATIME|syscall.MS_RELATIME|syscall.MS_STRICTATIME) != 0 {
+			inherited = inherited &^ (syscall.MS_NOATIME | syscall.MS_RELATIME | syscall.MS_STRICTATIME)
+		}
+		remountFlags = (flags | inherited) & bindRemountFlags
+	}
+	if err := syscall.Mount(source.SafePath(), target.SafePath(), "", flags, ""); err != nil {
+		return err
+	}
+	if remountFlags == 0 {
+		return nil
+	}
+	// The held target file descriptor refers to the covered directory,
+	// resolve the target again to get the new mount on top of it.
+	mounted, err := OpenAtNoFollow(target.Path())
+	if err != nil {
+		return fmt.Errorf("failed to open the new mount on %v: %w", target, err)
+	}
+	defer mounted.Close()
+	if err := syscall.Mount("", mounted.SafePath(), "", syscall.MS_REMOUNT|syscall.MS_BIND|remountFlags, ""); err != nil {
+		// don't leave a bind mount without the requested flags behind
+		_ = syscall.Unmount(mounted.SafePath(), unix.MNT_DETACH)
+		return fmt.Errorf("failed to apply the flags %#x to the bind mount on %v: %w", remountFlags, target, err)
+	}
+	return nil
+}
+
+// mountPropagation returns the propagation type of the mount on reference and
+// the MS_* flags which give another mount the same type, in the order they
+// have to be applied.
+func mountPropagation(reference *Path) (string, []uintptr, error) {
+	realPath, err := RealPathNoFollow(reference)
+	if err != nil {
+		return "", nil, err
+	}
+	mount, err := findMount(realPath)
+	if err != nil {
+		return "", nil, err
+	}
+	if mount == nil {
+		return "", nil, fmt.Errorf("%s is not a mount point", realPath)
+	}
+	propagation := mount.Propagation()
+	switch propagation {
+	case "shared":
+		return propagation, []uintptr{syscall.MS_SHARED}, nil
+	case "slave":
+		// the bind mount becomes a slave of the peers of its source, a
+		// private source leaves it private
+		return propagation, []uintptr{syscall.MS_SLAVE}, nil
+	case "shared,slave":
+		// a slave which is shared itself becomes a slave first, like
+		// with slave this requires a shared source of the bind mount
+		return propagation, []uintptr{syscall.MS_SLAVE, syscall.MS_SHARED}, nil
+	case "unbindable":
+		return propagation, []uintptr{syscall.MS_UNBINDABLE}, nil
+	default:
+		return propagation, []uintptr{syscall.MS_PRIVATE}, nil
+	}
+}
+
+// setPropagation applies the propagation flags in order to the topmost mount
+// on target.
+func setPropagation(target *File, flags []uintptr) error {
+	// The held target file descriptor refers to the covered directory,
+	// resolve the target again to get the new mount on top of it.
+	mounted, err := OpenAtNoFollow(target.Path())
+	if err != nil {
+		return fmt.Errorf("failed to open the new mount on %v: %w", target, err)
+	}
+	defer mounted.Close()
+	for _, flag := range flags {
+		if err := syscall.Mount("", mounted.SafePath(), "", flag, ""); err != nil {
+			return fmt.Errorf("failed to change the propagation of the mount on %v: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// transientMountErrors are the errors of a mount which may go away on their
+// own, e.g. EBUSY right after a loop device or device mapper target was set up.
+var transientMountErrors = []error{syscall.EBUSY, syscall.EAGAIN}
+
+// retryMount calls mount until it succeeds, fails with an error which is not
+// in transientMountErrors or was retried retries times. The delay before the
+// next attempt doubles after every attempt.
+func retryMount(mount func() error, retries int, delay time.Duration) error {
+	for attempt := 1; ; attempt++ {
+		err := mount()
+		if err == nil || attempt > retries {
+			return err
+		}
+		transient := false
+		for _, transientErr := range transientMountErrors {
+			transient = transient || errors.Is(err, transientErr)
+		}
+		if !transient {
+			return err
+		}
+		logger.Info("mount failed, retrying", "attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// verifyMount ensures that the topmost mount on target has the per mount
+// flags in flags set. A bind mount e.g. silently stays writable if ro is not
+// applied with a separate remount.
+func verifyMount(target *File, flags uintptr) error {
+	targetPath, err := os.Readlink(target.SafePath())
+	if err != nil {
+		return err
+	}
+	mount, err := findMount(targetPath)
+	if err != nil {
+		return err
+	}
+	if mount == nil {
+		return fmt.Errorf("no mount found on %s", targetPath)
+	}
+	options := map[string]bool{}
+	for _, option := range strings.Split(mount.Options, ",") {
+		options[option] = true
+	}
+	for _, f := range mountFlagOptions {
+		if flags&f.flag == 0 || options[f.option] {
+			continue
+		}
+		if flags&syscall.MS_BIND != 0 && flags&syscall.MS_REMOUNT == 0 {
+			return fmt.Errorf("%s is mounted without %s, options are %s, bind mounts need a remount to apply it", targetPath, f.option, mount.Options)
+		}
+		return fmt.Errorf("%s is mounted without %s, options are %s", targetPath, f.option, mount.Options)
+	}
+	logger.Info("verified mount", "target", targetPath, "options", mount.Options)
+	return nil
+}
+
+// checkBindTypes ensures that a bind mount does not mix directories and files.
+// Files, including device nodes, can only be bind mounted on files and
+// directories only on directories, otherwise the kernel fails with ENOTDIR.
+func checkBindTypes(source, target *File) error {
+	var sourceStat, targetStat unix.Stat_t
+	if err := unix.Fstat(source.fd, &sourceStat); err != nil {
+		return fmt.Errorf("failed to stat %v: %w", source.Path(), err)
+	}
+	if err := unix.Fstat(target.fd, &targetStat); err != nil {
+		return fmt.Errorf("failed to stat %v: %w", target.Path(), err)
+	}
+	sourceIsDir := sourceStat.Mode&unix.S_IFMT == unix.S_IFDIR
+	targetIsDir := targetStat.Mode&unix.S_IFMT == unix.S_IFDIR
+	if sourceIsDir != targetIsDir {
+		return usageError(fmt.Errorf("can't bind mount a %s on a %s", fileTypeName(sourceStat.Mode), fileTypeName(targetStat.Mode)))
+	}
+	return nil
+}
+
+// makeMountTarget creates the target of a mount if it does not exist yet below
+// its already existing parent. It is an empty file for bind mounts of files
+// and a directory otherwise.
+func makeMountTarget(source *File, bind bool, target string) error {
+	createFile := false
+	if bind {
+		var st unix.Stat_t
+		if err := unix.Fstat(source.fd, &st); err != nil {
+			return fmt.Errorf("failed to stat %v: %w", source.Path(), err)
+		}
+		createFile = st.Mode&unix.S_IFMT != unix.S_IFDIR
+	}
+	parent, name, err := NewParentNoFollow(target)
+	if err != nil {
+		return pathError(fmt.Errorf("mount target invalid: %w", err))
+	}
+	if err := checkAllowedChild(parent, name); err != nil {
+		return err
+	}
+	if createFile {
+		err = TouchAtNoFollow(parent, name, 0644)
+	} else {
+		err = MkdirAtNoFollow(parent, name, 0755)
+	}
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create the mount target: %w", err)
+	}
+	logger.Info("created mount target", "target", target)
+	return nil
+}
+
+// overlayData builds the mount data of an overlay filesystem from the file
+// descriptor paths of its directories, upper and work may be nil for a read
+// only overlay.
+func overlayData(lower []*File, upper, work *File) (string, error) {
+	if (upper == nil) != (work == nil) {
+		return "", fmt.Errorf("the upper and the work directory have to be given together")
+	}
+	lowerPaths := make([]string, 0, len(lower))
+	for _, dir := range lower {
+		lowerPaths = append(lowerPaths, dir.SafePath())
+	}
+	data := "lowerdir=" + strings.Join(lowerPaths, ":")
+	if upper == nil {
+		return data, nil
+	}
+	var upperStat, workStat unix.Stat_t
+	if err := unix.Fstat(upper.fd, &upperStat); err != nil {
+		return "", err
+	}
+	if err := unix.Fstat(work.fd, &workStat); err != nil {
+		return "", err
+	}
+	if upperStat.Dev != workStat.Dev {
+		return "", fmt.Errorf("the upper directory %v and the work directory %v have to be on the same filesystem", upper, work)
+	}
+	return data + ",upperdir=" + upper.SafePath() + ",workdir=" + work.SafePath(), nil
+}
+
+// tmpfsData builds the mount data of a tmpfs from a size in bytes with an
+// optional suffix or in percent of the memory, e.g. 50%, and an octal mode of
+// the root directory. Empty values are left to the kernel defaults.
+func tmpfsData(size, mode string) (string, error) {
+	var options []string
+	if size != "" {
+		if percent, ok := strings.CutSuffix(size, "%"); ok {
+			p, err := strconv.ParseUint(percent, 10, 32)
+			if err != nil || p == 0 {
+				return "", fmt.Errorf("invalid tmpfs size %q", size)
+			}
+			options = append(options, fmt.Sprintf("size=%d%%", p))
+		} else {
+			bytes, err := parseSize(size)
+			if err != nil {
+				return "", err
+			}
+			options = append(options, fmt.Sprintf("size=%d", bytes))
+		}
+	}
+	if mode != "" {
+		if _, err := parseFileMode(mode); err != nil {
+			return "", err
+		}
+		options = append(options, "mode="+mode)
+	}
+	return strings.Join(options, ","), nil
+}
+
+// unmount unmounts the mount at target. Unless MNT_DETACH is part of flags
+// the real path is unmounted, since the kernel refuses a non-lazy unmount
+// as long as we hold a file descriptor on the mount point.
+func unmount(out io.Writer, target *Path, flags int) error {
+	if flags&unix.MNT_DETACH == 0 {
+		// Resolve the real path via the file descriptor, release it and refuse
+		// to follow a symlink on the final element.
+		realPath, err := RealPathNoFollow(target)
+		if err != nil {
+			return err
+		}
+		logger.Info("unmounting", "target", target.String(), "path", realPath, "flags", fmt.Sprintf("%#x", flags|unix.UMOUNT_NOFOLLOW))
+		if dryRun {
+			fmt.Fprintf(out, "would unmount %q with flags %#x\n", realPath, flags|unix.UMOUNT_NOFOLLOW)
+			return nil
+		}
+		return syscall.Unmount(realPath, flags|unix.UMOUNT_NOFOLLOW)
+	}
+	return target.ExecuteNoFollow(func(safePath string) error {
+		logger.Info("unmounting", "target", target.String(), "safePath", safePath, "flags", fmt.Sprintf("%#x", flags))
+		if dryRun {
+			realPath, err := os.Readlink(safePath)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "would unmount %q with flags %#x\n", realPath, flags)
+			return nil
+		}
+		// we actively hold an open reference to the mount point,
+		// we have to lazy unmount, to not block ourselves
+		// with the active file-descriptor.
+		return syscall.Unmount(safePath, flags)
+	})
+}
+
+// unmountRecursive unmounts all mounts at or below target, deepest first.
+// Mounts which disappear between the enumeration and their unmount are skipped.
+func unmountRecursive(out io.Writer, target *Path, flags int) error {
+	realPath, err := RealPathNoFollow(target)
+	if err != nil {
+		return err
+	}
+	mounts, err := readMountInfo()
+	if err != nil {
+		return err
+	}
+
+	var subtree []MountInfo
+	for _, mount := range mounts {
+		if isBelow(realPath, mount.MountPoint) {
+			subtree = append(subtree, mount)
+		}
+	}
+	// Deeper mount points first, and for stacked mounts on the same mount
+	// point the most recent one first.
+	sort.SliceStable(subtree, func(i, j int) bool {
+		di := strings.Count(subtree[i].MountPoint, pathSeparator)
+		dj := strings.Count(subtree[j].MountPoint, pathSeparator)
+		if di != dj {
+			return di > dj
+		}
+		return subtree[i].ID > subtree[j].ID
+	})
+
+	for _, mount := range subtree {
+		mountPoint, err := NewPathNoFollow(mount.MountPoint)
+		if err == nil {
+			err = unmount(out, mountPoint, flags)
+		}
+		if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOENT) {
+			// already gone
+			logger.Debug("skipping mount which is already gone", "mountPoint", mount.MountPoint)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed unmounting %s: %w", mount.MountPoint, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	for _, tc := range []struct {
+		options string
+		flags   uintptr
+		valid   bool
+	}{
+		{"", 0, true},
+		{"ro", syscall.MS_RDONLY, true},
+		{"nosuid", syscall.MS_NOSUID, true},
+		{"nosuid,ro,bind", syscall.MS_NOSUID | syscall.MS_RDONLY | syscall.MS_BIND, true},
+		{" nosuid , ro ", syscall.MS_NOSUID | syscall.MS_RDONLY, true},
+		{"noexec,nodev,nosuid,ro,bind", syscall.MS_NOEXEC | syscall.MS_NODEV | syscall.MS_NOSUID | syscall.MS_RDONLY | syscall.MS_BIND, true},
+		{"rbind", syscall.MS_BIND | syscall.MS_REC, true},
+		{"remount,ro", syscall.MS_REMOUNT | syscall.MS_RDONLY, true},
+		{"relatime,relatime", syscall.MS_RELATIME, true},
+		{"lazytime", unix.MS_LAZYTIME, true},
+		{"lazytime,noatime", unix.MS_LAZYTIME | syscall.MS_NOATIME, true},
+		{"sync,dirsync", syscall.MS_SYNCHRONOUS | syscall.MS_DIRSYNC, true},
+		{"dirsync,ro", syscall.MS_DIRSYNC | syscall.MS_RDONLY, true},
+		{"mand", syscall.MS_MANDLOCK, true},
+		{"noatime,relatime", 0, false},
+		{"unknown", 0, false},
+		{"nosuid,unknown", 0, false},
+	} {
+		flags, err := parseMountOptions(tc.options)
+		if tc.valid != (err == nil) {
+			t.Errorf("parsing %q returned error %v", tc.options, err)
+			continue
+		}
+		if flags != tc.flags {
+			t.Errorf("parsing %q returned flags %#x instead of %#x", tc.options, flags, tc.flags)
+		}
+	}
+}
+
+func TestSplitMountOptions(t *testing.T) {
+	for _, tc := range []struct {
+		options string
+		escapes bool
+		parts   []string
+	}{
+		{"", false, []string{""}},
+		{"ro,nosuid", false, []string{"ro", "nosuid"}},
+		{`context="system_u:object_r:tmp_t:s0:c1,c2",ro`, false, []string{`context="system_u:object_r:tmp_t:s0:c1,c2"`, "ro"}},
+		{`a\,b,c`, true, []string{"a,b", "c"}},
+		{`a\,b,c`, false, []string{`a\`, "b", "c"}},
+		{`a\b`, true, []string{`a\b`}},
+		{`x="unterminated,ro`, false, []string{`x="unterminated,ro`}},
+	} {
+		parts := splitMountOptions(tc.options, tc.escapes)
+		if !reflect.DeepEqual(parts, tc.parts) {
+			t.Errorf("splitting %q returned %q instead of %q", tc.options, parts, tc.parts)
+		}
+	}
+}
+
+func TestParseMountOptionsData(t *testing.T) {
+	for _, tc := range []struct {
+		options string
+		flags   uintptr
+		data    string
+	}{
+		{"ro,errors=remount-ro", syscall.MS_RDONLY, "errors=remount-ro"},
+		{`context="system_u:object_r:tmp_t:s0:c1,c2",nosuid`, syscall.MS_NOSUID, `context="system_u:object_r:tmp_t:s0:c1,c2"`},
+		{`lowerdir=/a:/b,upperdir=/c\,d`, 0, "lowerdir=/a:/b,upperdir=/c,d"},
+	} {
+		flags, data, err := parseMountOptionsData(tc.options, true)
+		if err != nil {
+			t.Errorf("parsing %q failed: %v", tc.options, err)
+			continue
+		}
+		if flags != tc.flags || data != tc.data {
+			t.Errorf("parsing %q returned %#x and %q instead of %#x and %q", tc.options, flags, data, tc.flags, tc.data)
+		}
+	}
+	if _, _, err := parseMountOptionsData("ro,errors=remount-ro", false); err == nil {
+		t.Errorf("unknown option was accepted without passthrough")
+	}
+}
+
+// mountOptionsOf returns the per mount and the superblock options of the
+// mount on mountPoint in a mountinfo line printed by a test script.
+func mountOptionsOf(t *testing.T, out, mountPoint string) (options, superOptions []string) {
+	t.Helper()
+	for _, line := range strings.Split(out, "\n") {
+		mount, err := parseMountInfoLine(line)
+		if err == nil && mount.MountPoint == mountPoint {
+			return strings.Split(mount.Options, ","), strings.Split(mount.SuperOptions, ",")
+		}
+	}
+	t.Fatalf("no mount on %s in %s", mountPoint, out)
+	return nil, nil
+}
+
+func hasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMountNosuid(t *testing.T) {
+	dir := t.TempDir()
+	out := mustRunInMountNamespace(t, `
+$VC mount -t tmpfs -o nosuid,ro /tmp `+dir+`
+cat /proc/self/mountinfo
+`)
+	options, _ := mountOptionsOf(t, out, dir)
+	if !hasOption(options, "nosuid") || !hasOption(options, "ro") {
+		t.Fatalf("tmpfs is mounted with %v", options)
+	}
+}
+
+func TestOverlayMountData(t *testing.T) {
+	dir := t.TempDir()
+	out := mustRunInMountNamespace(t, `
+cd `+dir+`
+mkdir lower1 lower2 upper work merged
+echo 1 > lower1/one
+echo 2 > lower2/two
+$VC mount -t overlay --data "lowerdir=`+dir+`/lower1:`+dir+`/lower2,upperdir=`+dir+`/upper,workdir=`+dir+`/work" /tmp `+dir+`/merged
+cat merged/one merged/two
+`)
+	if out != "1\n2" {
+		t.Fatalf("overlay doesn't merge both lower directories: %s", out)
+	}
+}
+
+func TestNewAPIQuotedData(t *testing.T) {
+	dir := t.TempDir()
+	out, err := runInMountNamespace(t, `
+$VC mount --new-api -t tmpfs --data 'mode="0701",size=1m' /tmp `+dir+`
+cat /proc/self/mountinfo
+`)
+	if strings.Contains(out, "not supported") {
+		t.Skip("the kernel lacks the new mount API")
+	}
+	if err != nil {
+		t.Fatalf("script failed: %v\n%s", err, out)
+	}
+	_, superOptions := mountOptionsOf(t, out, dir)
+	if !hasOption(superOptions, "mode=701") || !hasOption(superOptions, "size=1024k") {
+		t.Fatalf("tmpfs is mounted with %v", superOptions)
+	}
+}
+
+func TestMountLazytime(t *testing.T) {
+	dir := t.TempDir()
+	out := mustRunInMountNamespace(t, `
+$VC mount -t tmpfs -o lazytime,relatime /tmp `+dir+`
+cat /proc/self/mountinfo
+`)
+	options, superOptions := mountOptionsOf(t, out, dir)
+	if !hasOption(superOptions, "lazytime") || !hasOption(options, "relatime") {
+		t.Fatalf("tmpfs is mounted with %v and %v", options, superOptions)
+	}
+}
+
+func TestMountSync(t *testing.T) {
+	dir := t.TempDir()
+	out := mustRunInMountNamespace(t, `
+$VC mount -t tmpfs -o sync,dirsync /tmp `+dir+`
+cat /proc/self/mountinfo
+$VC umount `+dir+`
+if grep -q " `+dir+` " /proc/self/mountinfo; then echo mounted; fi
+`)
+	if strings.HasSuffix(out, "mounted") {
+		t.Fatalf("tmpfs is still mounted after umount")
+	}
+	_, superOptions := mountOptionsOf(t, out, dir)
+	if !hasOption(superOptions, "sync") || !hasOption(superOptions, "dirsync") {
+		t.Fatalf("tmpfs is mounted with %v", superOptions)
+	}
+}
+
+func TestTmpfsData(t *testing.T) {
+	for _, tc := range []struct {
+		size, mode string
+		data       string
+		valid      bool
+	}{
+		{"", "", "", true},
+		{"64Mi", "", "size=67108864", true},
+		{"50%", "", "size=50%", true},
+		{"1G", "1777", "size=1000000000,mode=1777", true},
+		{"", "0700", "mode=0700", true},
+		{"0%", "", "", false},
+		{"x%", "", "", false},
+		{"1x", "", "", false},
+		{"", "0800", "", false},
+		{"", "17777", "", false},
+	} {
+		data, err := tmpfsData(tc.size, tc.mode)
+		if tc.valid != (err == nil) {
+			t.Errorf("size %q and mode %q returned error %v", tc.size, tc.mode, err)
+			continue
+		}
+		if data != tc.data {
+			t.Errorf("size %q and mode %q returned %q instead of %q", tc.size, tc.mode, data, tc.data)
+		}
+	}
+}
+
+func TestTmpfs(t *testing.T) {
+	dir := t.TempDir()
+	out := mustRunInMountNamespace(t, `
+$VC tmpfs --size 1Mi --mode 0701 -o nosuid `+dir+`
+cat /proc/self/mountinfo
+`)
+	options, superOptions := mountOptionsOf(t, out, dir)
+	if !hasOption(options, "nosuid") || !hasOption(superOptions, "size=1024k") || !hasOption(superOptions, "mode=701") {
+		t.Fatalf("tmpfs is mounted with %v and %v", options, superOptions)
+	}
+}
+
+func TestBindMountReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	out := mustRunInMountNamespace(t, `
+cd `+dir+`
+mkdir src dst
+mount -t tmpfs -o nosuid,nodev,noexec tmpfs src
+$VC mount -o bind,ro `+dir+`/src `+dir+`/dst
+grep " `+dir+`/dst " /proc/self/mountinfo
+if touch dst/file 2>/dev/null; then echo writable; fi
+`)
+	if strings.Contains(out, "writable") {
+		t.Fatalf("read only bind mount is writable")
+	}
+	for _, option := range []string{"ro", "nosuid", "nodev", "noexec"} {
+		if !strings.Contains(out, option+",") && !strings.Contains(out, ","+option) {
+			t.Errorf("bind mount lost %s: %s", option, out)
+		}
+	}
+}
+
+func TestBindMountKeepsRequestedAtime(t *testing.T) {
+	dir := t.TempDir()
+	out := mustRunInMountNamespace(t, `
+cd `+dir+`
+mkdir src dst
+mount -t tmpfs -o nosuid,strictatime tmpfs src
+$VC mount -o bind,noatime `+dir+`/src `+dir+`/dst
+grep " `+dir+`/dst " /proc/self/mountinfo
+`)
+	if !strings.Contains(out, "rw,nosuid,nodev,noatime") && !strings.Contains(out, "rw,nosuid,noatime") {
+		t.Errorf("bind mount has unexpected options: %s", out)
+	}
+}
+
+func TestBindMountKeepsStrictatime(t *testing.T) {
+	dir := t.TempDir()
+	out := mustRunInMountNamespace(t, `
+cd `+dir+`
+mkdir src dst
+mount -t tmpfs -o strictatime,nodiratime tmpfs src
+$VC mount -o bind,ro `+dir+`/src `+dir+`/dst
+cat /proc/self/mountinfo
+`)
+	options, _ := mountOptionsOf(t, out, dir+"/dst")
+	// with nodiratime in the remount the kernel doesn't keep the atime mode on its own
+	if !hasOption(options, "ro") || !hasOption(options, "nodiratime") || hasOption(options, "relatime") || hasOption(options, "noatime") {
+		t.Errorf("bind mount of a strictatime mount has options %v", options)
+	}
+}
+
+func TestIfNotMountedBindFlags(t *testing.T) {
+	dir := t.TempDir()
+	out, err := runInMountNamespace(t, `
+cd `+dir+`
+mkdir src dst
+mount -t tmpfs tmpfs src
+$VC mount -o bind `+dir+`/src `+dir+`/dst
+$VC mount --if-not-mounted -o bind `+dir+`/src `+dir+`/dst
+$VC mount --if-not-mounted -o bind,ro `+dir+`/src `+dir+`/dst
+`)
+	if err == nil || !strings.Contains(out, "already mounted with different options") {
+		t.Fatalf("a read write bind mount satisfied ro: %v\n%s", err, out)
+	}
+}
+
+func TestRunBindInMountNamespace(t *testing.T) {
+	dir := t.TempDir()
+	out := mustRunInMountNamespace(t, `
+cd `+dir+`
+mkdir src dst
+echo content > src/file
+$VC --mount /proc/self/ns/mnt run --bind `+dir+`/src:`+dir+`/dst:ro -- /bin/cat `+dir+`/dst/file
+`)
+	if out != "content" {
+		t.Fatalf("unexpected output of run: %s", out)
+	}
+}
+
+// bindTestFiles creates a file and a directory in a temporary directory.
+func bindTestFiles(t *testing.T) (dir, file, subdir string) {
+	t.Helper()
+	dir = t.TempDir()
+	file, subdir = filepath.Join(dir, "file"), filepath.Join(dir, "dir")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(subdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir, file, subdir
+}
+
+func openTestFile(t *testing.T, path string) *File {
+	t.Helper()
+	f, err := NewFileNoFollow(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestCheckBindTypes(t *testing.T) {
+	dir, file, subdir := bindTestFiles(t)
+	otherFile, otherDir := filepath.Join(dir, "other-file"), filepath.Join(dir, "other-dir")
+	if err := os.WriteFile(otherFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(otherDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		source, target string
+		valid          bool
+	}{
+		{file, otherFile, true},
+		{subdir, otherDir, true},
+		{file, otherDir, false},
+		{subdir, otherFile, false},
+	} {
+		err := checkBindTypes(openTestFile(t, tc.source), openTestFile(t, tc.target))
+		if tc.valid && err != nil {
+			t.Errorf("binding %s on %s was rejected: %v", tc.source, tc.target, err)
+		}
+		if !tc.valid && (err == nil || exitCode(err) != exitInvalidArgument) {
+			t.Errorf("binding %s on %s wasn't rejected as invalid: %v", tc.source, tc.target, err)
+		}
+	}
+}
+
+func TestMakeMountTarget(t *testing.T) {
+	dir, file, subdir := bindTestFiles(t)
+	for _, tc := range []struct {
+		name   string
+		source string
+		bind   bool
+		isDir  bool
+	}{
+		{"file-bind", file, true, false},
+		{"dir-bind", subdir, true, true},
+		// other mounts always need a directory
+		{"file-mount", file, false, true},
+	} {
+		target := filepath.Join(dir, tc.name)
+		if err := makeMountTarget(openTestFile(t, tc.source), tc.bind, target); err != nil {
+			t.Fatalf("creating %s failed: %v", target, err)
+		}
+		info, err := os.Lstat(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.IsDir() != tc.isDir || !info.IsDir() && !info.Mode().IsRegular() {
+			t.Errorf("%s was created as %v", target, info.Mode())
+		}
+		// an existing target is kept
+		if err := makeMountTarget(openTestFile(t, tc.source), tc.bind, target); err != nil {
+			t.Errorf("existing target %s isn't accepted: %v", target, err)
+		}
+	}
+}
+
+func TestBindMountMakeTarget(t *testing.T) {
+	dir, file, subdir := bindTestFiles(t)
+	if err := os.WriteFile(file, []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(subdir, "child"), []byte("dir"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := mustRunInMountNamespace(t, `
+$VC mount --make-target -o bind `+file+` `+dir+`/file-target
+$VC mount --make-target -o bind `+subdir+` `+dir+`/dir-target
+cat `+dir+`/file-target `+dir+`/dir-target/child
+`)
+	if out != "filedir" {
+		t.Fatalf("unexpected content of the bind mounts: %s", out)
+	}
+}
+
+func TestMountNoexec(t *testing.T) {
+	dir := t.TempDir()
+	out, err := runInMountNamespace(t, `
+$VC mount -t tmpfs -o noexec,nodev,nosuid /tmp `+dir+`
+printf '#!/bin/sh\necho executed\n' > `+dir+`/script
+chmod 755 `+dir+`/script
+`+dir+`/script
+`)
+	if err == nil || strings.Contains(out, "executed") || !strings.Contains(out, "Permission denied") {
+		t.Fatalf("a script on a noexec mount was executed: %v\n%s", err, out)
+	}
+}
+
+func TestRecursiveBindMount(t *testing.T) {
+	dir := t.TempDir()
+	out := mustRunInMountNamespace(t, `
+cd `+dir+`
+mkdir -p src/sub rbind bind
+mount -t tmpfs tmpfs src/sub
+echo submount > src/sub/file
+$VC mount -o rbind `+dir+`/src `+dir+`/rbind
+$VC mount -o bind `+dir+`/src `+dir+`/bind
+cat rbind/sub/file
+ls bind/sub
+`)
+	if out != "submount" {
+		t.Fatalf("unexpected content of the bind mounts: %s", out)
+	}
+}
+
+func TestPivotRoot(t *testing.T) {
+	dir := t.TempDir()
+	// only shell builtins work after the root changed
+	out := mustRunInMountNamespace(t, `
+mkdir `+dir+`/root
+mount -t tmpfs tmpfs `+dir+`/root
+mkdir `+dir+`/root/old
+echo tmpfs > `+dir+`/root/marker
+$VC pivot-root `+dir+`/root `+dir+`/root/old
+read line < /marker
+echo $line
+test -d /old`+dir+` && echo old
+`)
+	if out != "tmpfs\nold" {
+		t.Fatalf("the root wasn't changed to the tmpfs: %s", out)
+	}
+}
+
+func TestPivotRootEnsureMount(t *testing.T) {
+	dir := t.TempDir()
+	out, err := runInMountNamespace(t, `
+mkdir -p `+dir+`/root/old
+$VC pivot-root `+dir+`/root `+dir+`/root/old
+`)
+	if err == nil || !strings.Contains(out, "not a mount point") {
+		t.Fatalf("pivot root to a directory which is no mount point didn't fail: %v\n%s", err, out)
+	}
+	out = mustRunInMountNamespace(t, `
+mkdir -p `+dir+`/root/old
+echo directory > `+dir+`/root/marker
+$VC pivot-root --ensure-mount `+dir+`/root `+dir+`/root/old
+read line < /marker
+echo $line
+`)
+	if out != "directory" {
+		t.Fatalf("the root wasn't changed to the directory: %s", out)
+	}
+}
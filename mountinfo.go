@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// MountInfo is a single entry of /proc/self/mountinfo, see proc(5).
+type MountInfo struct {
+	ID             int
+	ParentID       int
+	Major          int
+	Minor          int
+	Root           string
+	MountPoint     string
+	Options        string
+	OptionalFields []string
+	FSType         string
+	Source         string
+	SuperOptions   string
+}
+
+// MountEntry is a mount as reported by the list-mounts subcommand.
+type MountEntry struct {
+	ID          int    `json:"id"`
+	ParentID    int    `json:"parentId"`
+	MountPoint  string `json:"mountPoint"`
+	Source      string `json:"source"`
+	FSType      string `json:"fsType"`
+	Options     string `json:"options"`
+	Propagation string `json:"propagation"`
+}
+
+// Entry returns the mount in the format of the list-mounts subcommand.
+func (m MountInfo) Entry() MountEntry {
+	return MountEntry{
+		ID:          m.ID,
+		ParentID:    m.ParentID,
+		MountPoint:  m.MountPoint,
+		Source:      m.Source,
+		FSType:      m.FSType,
+		Options:     m.Options,
+		Propagation: m.Propagation(),
+	}
+}
+
+// Propagation returns the propagation type of the mount: private, shared,
+// slave, shared,slave for a slave which is shared itself, or unbindable.
+func (m MountInfo) Propagation() string {
+	var types []string
+	for _, field := range m.OptionalFields {
+		switch {
+		case strings.HasPrefix(field, "shared:"):
+			types = append([]string{"shared"}, types...)
+		case strings.HasPrefix(field, "master:"):
+			types = append(types, "slave")
+		case field == "unbindable":
+			types = append(types, "unbindable")
+		}
+	}
+	if len(types) == 0 {
+		return "private"
+	}
+	return strings.Join(types, ",")
+}
+
+// readMountInfo parses the mount table of the mount namespace the process is in.
+func readMountInfo() ([]MountInfo, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", mountInfoPath, err)
+	}
+	defer f.Close()
+
+	var mounts []MountInfo
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		mount, err := parseMountInfoLine(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", mountInfoPath, err)
+	}
+	return mounts, nil
+}
+
+func parseMountInfoLine(line string) (MountInfo, error) {
+	// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+	fields := strings.Fields(line)
+	separator := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			separator = i
+			break
+		}
+	}
+	if separator < 0 || len(fields) < separator+4 {
+		return MountInfo{}, fmt.Errorf("malformed mountinfo line %q", line)
+	}
+
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return MountInfo{}, fmt.Errorf("malformed mount id in mountinfo line %q: %w", line, err)
+	}
+	parentID, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return MountInfo{}, fmt.Errorf("malformed parent id in mountinfo line %q: %w", line, err)
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(fields[2], "%d:%d", &major, &minor); err != nil {
+		return MountInfo{}, fmt.Errorf("malformed device in mountinfo line %q: %w", line, err)
+	}
+
+	return MountInfo{
+		ID:             id,
+		ParentID:       parentID,
+		Major:          major,
+		Minor:          minor,
+		Root:           unescapeMountInfo(fields[3]),
+		MountPoint:     unescapeMountInfo(fields[4]),
+		Options:        fields[5],
+		OptionalFields: fields[6:separator],
+		FSType:         fields[separator+1],
+		Source:         unescapeMountInfo(fields[separator+2]),
+		SuperOptions:   fields[separator+3],
+	}, nil
+}
+
+// unescapeMountInfo reverts the octal escaping of whitespace and backslashes
+// the kernel applies to paths in mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// isBelow reports whether path is equal to or located below parent.
+func isBelow(parent, path string) bool {
+	parent = filepath.Clean(parent)
+	path = filepath.Clean(path)
+	if parent == pathRoot {
+		return true
+	}
+	return path == parent || strings.HasPrefix(path, parent+pathSeparator)
+}
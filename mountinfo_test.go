@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMountInfoLine(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		mount MountInfo
+		valid bool
+	}{
+		{
+			line: "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue",
+			mount: MountInfo{ID: 36, ParentID: 35, Major: 98, Minor: 0, Root: "/mnt1", MountPoint: "/mnt2",
+				Options: "rw,noatime", OptionalFields: []string{"master:1"}, FSType: "ext3", Source: "/dev/root",
+				SuperOptions: "rw,errors=continue"},
+			valid: true,
+		},
+		{
+			line: "25 1 0:22 / /run rw,nosuid - tmpfs tmpfs rw,mode=755",
+			mount: MountInfo{ID: 25, ParentID: 1, Major: 0, Minor: 22, Root: "/", MountPoint: "/run",
+				Options: "rw,nosuid", OptionalFields: []string{}, FSType: "tmpfs", Source: "tmpfs",
+				SuperOptions: "rw,mode=755"},
+			valid: true,
+		},
+		{
+			line: `40 25 0:23 /a\040b /mnt/with\040space\011tab rw shared:1 master:2 - tmpfs back\134slash rw`,
+			mount: MountInfo{ID: 40, ParentID: 25, Major: 0, Minor: 23, Root: "/a b", MountPoint: "/mnt/with space\ttab",
+				Options: "rw", OptionalFields: []string{"shared:1", "master:2"}, FSType: "tmpfs", Source: `back\slash`,
+				SuperOptions: "rw"},
+			valid: true,
+		},
+		{line: "", valid: false},
+		{line: "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 ext3 /dev/root rw", valid: false},
+		{line: "36 35 98:0 /mnt1 /mnt2 rw - ext3 /dev/root", valid: false},
+		{line: "x 35 98:0 / /mnt rw - ext3 /dev/root rw", valid: false},
+		{line: "36 x 98:0 / /mnt rw - ext3 /dev/root rw", valid: false},
+		{line: "36 35 98 / /mnt rw - ext3 /dev/root rw", valid: false},
+	} {
+		mount, err := parseMountInfoLine(tc.line)
+		if tc.valid != (err == nil) {
+			t.Errorf("parsing %q returned error %v", tc.line, err)
+			continue
+		}
+		if tc.valid && !reflect.DeepEqual(mount, tc.mount) {
+			t.Errorf("parsing %q returned %+v instead of %+v", tc.line, mount, tc.mount)
+		}
+	}
+}
+
+func TestUnescapeMountInfo(t *testing.T) {
+	for _, tc := range []struct {
+		escaped, path string
+	}{
+		{"/plain", "/plain"},
+		{`/a\040b`, "/a b"},
+		{`\040`, " "},
+		{`/a\012b`, "/a\nb"},
+		{`/a\134`, `/a\`},
+		{`/a\04`, `/a\04`},
+		{`/a\999`, `/a\999`},
+	} {
+		if path := unescapeMountInfo(tc.escaped); path != tc.path {
+			t.Errorf("unescaping %q returned %q instead of %q", tc.escaped, path, tc.path)
+		}
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	for _, tc := range []struct {
+		fields      []string
+		propagation string
+	}{
+		{nil, "private"},
+		{[]string{"shared:1"}, "shared"},
+		{[]string{"master:2"}, "slave"},
+		{[]string{"master:2", "shared:1"}, "shared,slave"},
+		{[]string{"shared:1", "master:2"}, "shared,slave"},
+		{[]string{"unbindable"}, "unbindable"},
+		{[]string{"propagate_from:3", "master:2"}, "slave"},
+	} {
+		if propagation := (MountInfo{OptionalFields: tc.fields}).Propagation(); propagation != tc.propagation {
+			t.Errorf("optional fields %v returned %s instead of %s", tc.fields, propagation, tc.propagation)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// namespace is a namespace to join, referenced by its nsfs file,
+// e.g. /proc/<pid>/ns/mnt.
+type namespace struct {
+	name   string
+	path   string
+	nstype int
+}
+
+// targetNamespacePath returns the nsfs file of the namespace ns of process pid.
+func targetNamespacePath(pid int, ns string) string {
+	return fmt.Sprintf("/proc/%d/ns/%s", pid, ns)
+}
+
+// nsfsNames maps namespace types to their file in /proc/<pid>/ns. For pid
+// namespaces setns changes the namespace of children, not of the caller.
+var nsfsNames = map[int]string{
+	unix.CLONE_NEWNS:  "mnt",
+	unix.CLONE_NEWPID: "pid_for_children",
+	unix.CLONE_NEWNET: "net",
+	unix.CLONE_NEWIPC: "ipc",
+	unix.CLONE_NEWUTS: "uts",
+}
+
+// joinNamespaces joins the given namespaces in order. All namespace files are
+// opened before the first namespace is joined, so that their paths are resolved
+// in the mount namespace of the caller.
+//
+// Joining a namespace can't be rolled back, returning to the original
+// namespaces may require privileges or paths which are gone once a namespace
+// was joined. A failure therefore leaves the thread in the namespaces joined
+// before it, the returned error names the namespace which failed and the ones
+// already joined, and the caller has to exit instead of continuing.
+func joinNamespaces(namespaces []namespace) error {
+	files := make([]*os.File, 0, len(namespaces))
+	originals := make([]*os.File, 0, len(namespaces))
+	defer func() {
+		for _, f := range append(files, originals...) {
+			if f != nil {
+				_ = f.Close()
+			}
+		}
+	}()
+	for _, ns := range namespaces {
+		f, err := os.Open(ns.path)
+		if err != nil {
+			return fmt.Errorf("failed to open %s namespace: %w", ns.name, err)
+		}
+		files = append(files, f)
+		logger.Debug("opened namespace file", "namespace", ns.name, "path", ns.path)
+
+		// the original namespace is only kept to report where a failed
+		// join left the thread
+		original, err := os.Open("/proc/thread-self/ns/" + nsfsNames[ns.nstype])
+		if err != nil {
+			return fmt.Errorf("failed to open the original %s namespace: %w", ns.name, err)
+		}
+		originals = append(originals, original)
+	}
+
+	var joined []string
+	for i, ns := range namespaces {
+		if ns.nstype == unix.CLONE_NEWNS {
+			if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+				return joinNamespaceError(ns, originals[i], joined, fmt.Errorf("failed to detach from parent mount namespace: %w", err))
+			}
+		}
+		if err := unix.Setns(int(files[i].Fd()), ns.nstype); err != nil {
+			return joinNamespaceError(ns, originals[i], joined, fmt.Errorf("failed to join the %s namespace: %w", ns.name, err))
+		}
+		logger.Info("joined namespace", "namespace", ns.name, "path", ns.path)
+		joined = append(joined, ns.name)
+		// the namespace file is not needed anymore once joined, don't carry
+		// it over into namespaces joined later
+		_ = files[i].Close()
+		files[i] = nil
+	}
+	return nil
+}
+
+// joinNamespaceError adds the namespaces already joined and the namespace the
+// thread remains in to the error of a failed join.
+func joinNamespaceError(ns namespace, original *os.File, joined []string, err error) error {
+	if id, readErr := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", original.Fd())); readErr == nil {
+		err = fmt.Errorf("%w, still in the original %s namespace %s", err, ns.name, id)
+	}
+	if len(joined) > 0 {
+		err = fmt.Errorf("%w, already joined the %s namespaces which can't be rolled back", err, strings.Join(joined, ", "))
+	}
+	return err
+}
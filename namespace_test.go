@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// startNamespaceHolder runs the shell script in new namespaces of the given
+// types and keeps it alive until the test ends. It returns the pid once the
+// script printed a line.
+func startNamespaceHolder(t *testing.T, cloneflags uintptr, script string) int {
+	t.Helper()
+	requireRoot(t)
+	cmd := exec.Command("/bin/sh", "-c", script+"; echo ready; exec sleep 600")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: cloneflags}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	if _, err := bufio.NewReader(stdout).ReadString('\n'); err != nil {
+		t.Fatalf("namespace holder failed: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestJoinUTSAndIPCNamespaces(t *testing.T) {
+	pid := startNamespaceHolder(t, syscall.CLONE_NEWUTS|syscall.CLONE_NEWIPC, "hostname virt-chroot-test")
+	ipc, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/ipc", pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := virtChroot("--uts", fmt.Sprintf("/proc/%d/ns/uts", pid), "--ipc", fmt.Sprintf("/proc/%d/ns/ipc", pid),
+		"exec", "--", "/bin/sh", "-c", "hostname; readlink /proc/self/ns/ipc").CombinedOutput()
+	if err != nil {
+		t.Fatalf("exec failed: %v\n%s", err, out)
+	}
+	if string(out) != "virt-chroot-test\n"+ipc+"\n" {
+		t.Fatalf("the namespaces weren't joined: %s", out)
+	}
+
+	// without --ipc only the uts namespace is joined
+	out, err = virtChroot("--uts", fmt.Sprintf("/proc/%d/ns/uts", pid), "exec", "--", "/bin/readlink", "/proc/self/ns/ipc").CombinedOutput()
+	if err != nil {
+		t.Fatalf("exec failed: %v\n%s", err, out)
+	}
+	if string(out) == ipc+"\n" {
+		t.Fatalf("the ipc namespace was joined without --ipc")
+	}
+}
+
+func TestUnshareJoinsGlobalNamespaces(t *testing.T) {
+	out := mustRunInMountNamespace(t, `
+$VC --mount /proc/self/ns/mnt unshare --new-uts --new-pid -- /bin/sh -c 'hostname unshared; hostname; echo $$'
+`)
+	if out != "unshared\n1" {
+		t.Fatalf("unexpected output of unshare: %s", out)
+	}
+}
+
+func TestUnshareRequiresNamespace(t *testing.T) {
+	out, err := virtChroot("unshare", "--", "/bin/true").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "at least one of --new-mount") {
+		t.Fatalf("unshare without namespaces didn't fail: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountAttrs translates the per mount MS_* flags into the MOUNT_ATTR_*
+// attributes to set and to clear with mount_setattr.
+func mountAttrs(flags uintptr) (set, clear uint64) {
+	for _, attr := range []struct {
+		flag uintptr
+		attr uint64
+	}{
+		{syscall.MS_RDONLY, unix.MOUNT_ATTR_RDONLY},
+		{syscall.MS_NOSUID, unix.MOUNT_ATTR_NOSUID},
+		{syscall.MS_NODEV, unix.MOUNT_ATTR_NODEV},
+		{syscall.MS_NOEXEC, unix.MOUNT_ATTR_NOEXEC},
+		{syscall.MS_NODIRATIME, unix.MOUNT_ATTR_NODIRATIME},
+		{unix.MS_NOSYMFOLLOW, unix.MOUNT_ATTR_NOSYMFOLLOW},
+	} {
+		if flags&attr.flag != 0 {
+			set |= attr.attr
+		}
+	}
+	// the atime attributes are a value, which has to be cleared to be changed
+	switch {
+	case flags&syscall.MS_NOATIME != 0:
+		set, clear = set|unix.MOUNT_ATTR_NOATIME, clear|unix.MOUNT_ATTR__ATIME
+	case flags&syscall.MS_STRICTATIME != 0:
+		set, clear = set|unix.MOUNT_ATTR_STRICTATIME, clear|unix.MOUNT_ATTR__ATIME
+	case flags&syscall.MS_RELATIME != 0:
+		set, clear = set|unix.MOUNT_ATTR_RELATIME, clear|unix.MOUNT_ATTR__ATIME
+	}
+	return set, clear
+}
+
+// IdmappedBindMountNoFollow bind mounts source on target with the ids mapped
+// through the user namespace userns. The mount is created detached from the
+// held source file descriptor and attached to the held target file
+// descriptor, so that no path is resolved again.
+func IdmappedBindMountNoFollow(source, target *File, userns *os.File, flags uintptr) error {
+	treeFlags := uint(unix.OPEN_TREE_CLONE | unix.OPEN_TREE_CLOEXEC | unix.AT_EMPTY_PATH)
+	setattrFlags := uint(unix.AT_EMPTY_PATH)
+	if flags&syscall.MS_REC != 0 {
+		treeFlags |= unix.AT_RECURSIVE
+		setattrFlags |= unix.AT_RECURSIVE
+	}
+	tree, err := unix.OpenTree(source.fd, "", treeFlags)
+	if errors.Is(err, syscall.ENOSYS) {
+		return fmt.Errorf("idmapped mounts are not supported, they require Linux 5.12 or newer: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to clone the mount of %v: %w", source, err)
+	}
+	defer unix.Close(tree)
+
+	set, clear := mountAttrs(flags)
+	attr := &unix.MountAttr{
+		Attr_set:  set | unix.MOUNT_ATTR_IDMAP,
+		Attr_clr:  clear,
+		Userns_fd: uint64(userns.Fd()),
+	}
+	err = unix.MountSetattr(tree, "", setattrFlags, attr)
+	if errors.Is(err, syscall.ENOSYS) {
+		return fmt.Errorf("idmapped mounts are not supported, they require Linux 5.12 or newer: %w", err)
+	}
+	if errors.Is(err, syscall.EINVAL) {
+		return fmt.Errorf("failed to idmap the mount of %v, the filesystem may not support idmapped mounts or %s is no user namespace: %w", source, userns.Name(), err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to idmap the mount of %v: %w", source, err)
+	}
+
+	if err := unix.MoveMount(tree, "", target.fd, "", unix.MOVE_MOUNT_F_EMPTY_PATH|unix.MOVE_MOUNT_T_EMPTY_PATH); err != nil {
+		return fmt.Errorf("failed to attach the idmapped mount to %v: %w", target, err)
+	}
+	return nil
+}
+
+// FdBindMountNoFollow bind mounts source on target without going through
+// paths at all. The mount of the held source file descriptor is cloned with
+// open_tree, gets the per mount flags applied with mount_setattr and is
+// attached to the held target file descriptor with move_mount. Unlike the
+// /proc/self/fd paths used with mount(2), nothing is resolved by the kernel
+// again after the checks.
+func FdBindMountNoFollow(source, target *File, flags uintptr) error {
+	treeFlags := uint(unix.OPEN_TREE_CLONE | unix.OPEN_TREE_CLOEXEC | unix.AT_EMPTY_PATH)
+	setattrFlags := uint(unix.AT_EMPTY_PATH)
+	if flags&syscall.MS_REC != 0 {
+		treeFlags |= unix.AT_RECURSIVE
+		setattrFlags |= unix.AT_RECURSIVE
+	}
+	tree, err := unix.OpenTree(source.fd, "", treeFlags)
+	if err != nil {
+		return fmt.Errorf("failed to clone the mount of %v: %w", source, err)
+	}
+	defer unix.Close(tree)
+	if set, clear := mountAttrs(flags); set != 0 || clear != 0 {
+		attr := &unix.MountAttr{Attr_set: set, Attr_clr: clear}
+		if err := unix.MountSetattr(tree, "", setattrFlags, attr); err != nil {
+			return fmt.Errorf("failed to set the flags of the mount of %v: %w", source, err)
+		}
+	}
+	return attachMount(tree, target)
+}
+
+// NewAPIMountNoFollow mounts source on target with the fsopen, fsconfig,
+// fsmount and move_mount syscalls. The filesystem parameters are passed
+// individually from the comma separated data, and the messages of the kernel
+// are part of the returned error. Bind mounts are cloned with open_tree by
+// FdBindMountNoFollow, which applies the per mount flags with mount_setattr.
+// The mount is attached to the held target file descriptor. ENOSYS is
+// returned if the kernel lacks the new mount API.
+func NewAPIMountNoFollow(source, target *File, fsType string, flags uintptr, data string) error {
+	if flags&syscall.MS_BIND != 0 {
+		return FdBindMountNoFollow(source, target, flags)
+	}
+
+	fsfd, err := unix.Fsopen(fsType, unix.FSOPEN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to open filesystem type %s: %w", fsType, err)
+	}
+	defer unix.Close(fsfd)
+	if source != nil {
+		if err := unix.FsconfigSetString(fsfd, "source", source.SafePath()); err != nil {
+			return fsContextError(fsfd, fmt.Sprintf("failed to set the source %v", source), err)
+		}
+	}
+	// read only applies to the superblock as well, like with mount(2)
+	for _, sb := range []struct {
+		flag uintptr
+		name string
+	}{
+		{syscall.MS_RDONLY, "ro"},
+		{unix.MS_LAZYTIME, "lazytime"},
+		{syscall.MS_SYNCHRONOUS, "sync"},
+		{syscall.MS_DIRSYNC, "dirsync"},
+		{syscall.MS_MANDLOCK, "mand"},
+	} {
+		if flags&sb.flag == 0 {
+			continue
+		}
+		if err := unix.FsconfigSetFlag(fsfd, sb.name); err != nil {
+			return fsContextError(fsfd, "failed to set "+sb.name, err)
+		}
+	}
+	for _, param := range splitMountOptions(data, false) {
+		if param == "" {
+			continue
+		}
+		if key, value, ok := strings.Cut(param, "="); ok {
+			// fsconfig takes the value as is, the quotes only protect
+			// commas within it while splitting
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			err = unix.FsconfigSetString(fsfd, key, value)
+		} else {
+			err = unix.FsconfigSetFlag(fsfd, param)
+		}
+		if err != nil {
+			return fsContextError(fsfd, "failed to set "+param, err)
+		}
+	}
+	if err := unix.FsconfigCreate(fsfd); err != nil {
+		return fsContextError(fsfd, "failed to create the filesystem", err)
+	}
+	attrs, _ := mountAttrs(flags)
+	mnt, err := unix.Fsmount(fsfd, unix.FSMOUNT_CLOEXEC, int(attrs))
+	if err != nil {
+		return fsContextError(fsfd, "failed to create the mount", err)
+	}
+	defer unix.Close(mnt)
+	return attachMount(mnt, target)
+}
+
+// attachMount attaches the detached mount mnt to the held target file descriptor.
+func attachMount(mnt int, target *File) error {
+	if err := unix.MoveMount(mnt, "", target.fd, "", unix.MOVE_MOUNT_F_EMPTY_PATH|unix.MOVE_MOUNT_T_EMPTY_PATH); err != nil {
+		return fmt.Errorf("failed to attach the mount to %v: %w", target, err)
+	}
+	return nil
+}
+
+// fsContextError adds the messages the kernel logged to the filesystem
+// context fsfd to err.
+func fsContextError(fsfd int, msg string, err error) error {
+	var messages []string
+	buf := make([]byte, 4096)
+	for {
+		n, readErr := unix.Read(fsfd, buf)
+		if readErr != nil || n <= 0 {
+			break
+		}
+		// messages are prefixed with e, w or i for their severity
+		messages = append(messages, strings.TrimSpace(string(buf[:n])))
+	}
+	if len(messages) == 0 {
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+	return fmt.Errorf("%s: %w: %s", msg, err, strings.Join(messages, "; "))
+}
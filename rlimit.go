@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// rlimitResources maps the names accepted by --rlimit to their resources.
+var rlimitResources = map[string]int{
+	"AS":         unix.RLIMIT_AS,
+	"CORE":       unix.RLIMIT_CORE,
+	"CPU":        unix.RLIMIT_CPU,
+	"DATA":       unix.RLIMIT_DATA,
+	"FSIZE":      unix.RLIMIT_FSIZE,
+	"LOCKS":      unix.RLIMIT_LOCKS,
+	"MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"NICE":       unix.RLIMIT_NICE,
+	"NOFILE":     unix.RLIMIT_NOFILE,
+	"NPROC":      unix.RLIMIT_NPROC,
+	"RSS":        unix.RLIMIT_RSS,
+	"RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RTTIME":     unix.RLIMIT_RTTIME,
+	"SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"STACK":      unix.RLIMIT_STACK,
+}
+
+// rlimit is a resource limit flag. It accepts either a single value which is
+// used as soft and hard limit, or a "soft:hard" pair. A zero limit is not applied.
+type rlimit struct {
+	syscall.Rlimit
+}
+
+func (r *rlimit) String() string {
+	if r.Cur == r.Max {
+		return strconv.FormatUint(r.Max, 10)
+	}
+	return fmt.Sprintf("%d:%d", r.Cur, r.Max)
+}
+
+func (r *rlimit) Set(value string) error {
+	limit, err := parseRlimit(value)
+	if err != nil {
+		return err
+	}
+	r.Rlimit = limit
+	return nil
+}
+
+func (r *rlimit) Type() string {
+	return "limit"
+}
+
+func (r *rlimit) isSet() bool {
+	return r.Cur != 0 || r.Max != 0
+}
+
+func parseRlimit(value string) (syscall.Rlimit, error) {
+	soft, hard, found := strings.Cut(value, ":")
+	cur, err := strconv.ParseUint(soft, 10, 64)
+	if err != nil {
+		return syscall.Rlimit{}, fmt.Errorf("invalid soft limit %q: %w", soft, err)
+	}
+	if !found {
+		return syscall.Rlimit{Cur: cur, Max: cur}, nil
+	}
+	max, err := strconv.ParseUint(hard, 10, 64)
+	if err != nil {
+		return syscall.Rlimit{}, fmt.Errorf("invalid hard limit %q: %w", hard, err)
+	}
+	if cur > max {
+		return syscall.Rlimit{}, fmt.Errorf("soft limit %d exceeds hard limit %d", cur, max)
+	}
+	return syscall.Rlimit{Cur: cur, Max: max}, nil
+}
+
+// parseNamedRlimit parses a NAME=limit or NAME=soft:hard resource limit.
+// Unlike the dedicated limit flags, a zero limit is applied.
+func parseNamedRlimit(value string) (int, syscall.Rlimit, error) {
+	name, limit, found := strings.Cut(value, "=")
+	if !found {
+		return 0, syscall.Rlimit{}, fmt.Errorf("resource limit %q must be of the form NAME=value", value)
+	}
+	resource, ok := rlimitResources[strings.ToUpper(name)]
+	if !ok {
+		var names []string
+		for n := range rlimitResources {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return 0, syscall.Rlimit{}, fmt.Errorf("resource %s is not supported, supported resources are: %s", name, strings.Join(names, ", "))
+	}
+	rlim, err := parseRlimit(limit)
+	if err != nil {
+		return 0, syscall.Rlimit{}, fmt.Errorf("invalid limit for resource %s: %w", name, err)
+	}
+	return resource, rlim, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseRlimit(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		limit syscall.Rlimit
+		valid bool
+	}{
+		{"1024", syscall.Rlimit{Cur: 1024, Max: 1024}, true},
+		{"0", syscall.Rlimit{}, true},
+		{"512:1024", syscall.Rlimit{Cur: 512, Max: 1024}, true},
+		{"1024:1024", syscall.Rlimit{Cur: 1024, Max: 1024}, true},
+		{"18446744073709551615", syscall.Rlimit{Cur: 1<<64 - 1, Max: 1<<64 - 1}, true},
+		{"2048:1024", syscall.Rlimit{}, false},
+		{"-1", syscall.Rlimit{}, false},
+		{"1k", syscall.Rlimit{}, false},
+		{":1024", syscall.Rlimit{}, false},
+		{"1024:", syscall.Rlimit{}, false},
+		{"", syscall.Rlimit{}, false},
+	} {
+		limit, err := parseRlimit(tc.value)
+		if tc.valid != (err == nil) {
+			t.Errorf("parsing %q returned error %v", tc.value, err)
+			continue
+		}
+		if limit != tc.limit {
+			t.Errorf("parsing %q returned %+v instead of %+v", tc.value, limit, tc.limit)
+		}
+	}
+}
+
+func TestRlimitFlag(t *testing.T) {
+	var r rlimit
+	if r.isSet() {
+		t.Errorf("zero limit is set")
+	}
+	if err := r.Set("1:2"); err != nil {
+		t.Fatal(err)
+	}
+	if !r.isSet() || r.String() != "1:2" {
+		t.Errorf("unexpected limit %s", r.String())
+	}
+	if err := r.Set("3"); err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != "3" {
+		t.Errorf("unexpected limit %s", r.String())
+	}
+}
+
+func TestParseNamedRlimit(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		resource int
+		limit    syscall.Rlimit
+		valid    bool
+	}{
+		{"STACK=8388608", unix.RLIMIT_STACK, syscall.Rlimit{Cur: 8388608, Max: 8388608}, true},
+		{"core=0", unix.RLIMIT_CORE, syscall.Rlimit{}, true},
+		{"NOFILE=1024:4096", unix.RLIMIT_NOFILE, syscall.Rlimit{Cur: 1024, Max: 4096}, true},
+		{"UNKNOWN=1", 0, syscall.Rlimit{}, false},
+		{"STACK", 0, syscall.Rlimit{}, false},
+		{"STACK=big", 0, syscall.Rlimit{}, false},
+	} {
+		resource, limit, err := parseNamedRlimit(tc.value)
+		if tc.valid != (err == nil) {
+			t.Errorf("parsing %q returned error %v", tc.value, err)
+			continue
+		}
+		if resource != tc.resource || limit != tc.limit {
+			t.Errorf("parsing %q returned %d %+v instead of %d %+v", tc.value, resource, limit, tc.resource, tc.limit)
+		}
+	}
+}
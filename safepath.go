@@ -13,6 +13,10 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// maxSymlinks is the maximum number of symlinks JoinAndResolveWithRelativeRoot
+// follows, by default the limit of the kernel.
+var maxSymlinks = 40
+
 // JoinAndResolveWithRelativeRoot joins an absolute relativeRoot base path with
 // additional elements which have to be kept below the relativeRoot base.
 // Relative and absolute links will be resolved relative to the provided rootBase
@@ -24,6 +28,7 @@ func JoinAndResolveWithRelativeRoot(rootBase string, elems ...string) (*Path, er
 	}
 
 	path := pathRoot
+	links := 0
 	fifo := newLimitedFifo(256)
 	for i := len(elems) - 1; i >= 0; i-- {
 		if err := fifo.push(strings.Split(filepath.Clean(elems[i]), pathSeparator)); err != nil {
@@ -41,6 +46,10 @@ func JoinAndResolveWithRelativeRoot(rootBase string, elems ...string) (*Path, er
 			return nil, err
 		}
 		if link != "" {
+			links++
+			if links > maxSymlinks {
+				return nil, fmt.Errorf("more than %v symlinks evaluated: %w", maxSymlinks, syscall.ELOOP)
+			}
 			if err := fifo.push(strings.Split(link, pathSeparator)); err != nil {
 				return nil, err
 			}
@@ -214,22 +223,11 @@ func StatAtNoFollow(path *Path) (os.FileInfo, error) {
 }
 
 func GetxattrNoFollow(path *Path, attr string) ([]byte, error) {
-	var ret []byte
-	pathFd, err := OpenAtNoFollow(path)
-	if err != nil {
-		return nil, err
+	ret, err := GetxattrRawNoFollow(path, attr)
+	if err != nil || len(ret) == 0 {
+		return ret, err
 	}
-	defer pathFd.Close()
-	size, err := syscall.Getxattr(pathFd.SafePath(), attr, ret)
-	if err != nil {
-		return nil, err
-	}
-	ret = make([]byte, size)
-	_, err = syscall.Getxattr(pathFd.SafePath(), attr, ret)
-	if err != nil {
-		return nil, err
-	}
-
+	// drop the terminating null byte of e.g. SELinux labels
 	return ret[:len(ret)-1], nil
 }
 
@@ -65,12 +65,14 @@ func advance(rootBase string, parent string, child string) (string, string, erro
 }
 
 // openat helps traversing a path without following symlinks
-// to ensure safe path references on user-owned paths by privileged processes
+// to ensure safe path references on user-owned paths by privileged processes.
+// Like all descriptors of the SafePath helpers it is close-on-exec, so that
+// it never leaks into an executed command.
 func openat(dirfd int, path string) (fd int, err error) {
 	if err := isSingleElement(path); err != nil {
 		return -1, err
 	}
-	return unix.Openat(dirfd, path, unix.O_NOFOLLOW|unix.O_PATH, 0)
+	return unix.Openat(dirfd, path, unix.O_NOFOLLOW|unix.O_PATH|unix.O_CLOEXEC, 0)
 }
 
 func unlinkat(dirfd int, path string, flags int) error {
@@ -84,7 +86,7 @@ func touchat(dirfd int, path string, mode uint32) (fd int, err error) {
 	if err := isSingleElement(path); err != nil {
 		return -1, err
 	}
-	return unix.Openat(dirfd, path, unix.O_NOFOLLOW|syscall.O_CREAT|syscall.O_EXCL, mode)
+	return unix.Openat(dirfd, path, unix.O_NOFOLLOW|syscall.O_CREAT|syscall.O_EXCL|unix.O_CLOEXEC, mode)
 }
 
 func mknodat(dirfd int, path string, mode uint32, dev uint64) (err error) {
@@ -95,7 +97,7 @@ func mknodat(dirfd int, path string, mode uint32, dev uint64) (err error) {
 }
 
 func open(path string) (fd int, err error) {
-	return syscall.Open(path, unix.O_PATH, 0)
+	return syscall.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
 }
 
 func path(fd int) string {
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// symlinkChain creates a chain of n symlinks ending in a file and returns the
+// name of the first link relative to dir.
+func symlinkChain(t *testing.T, dir string, n int) string {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "target"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	next := "/target"
+	for i := n; i > 0; i-- {
+		name := fmt.Sprintf("link%d", i)
+		if err := os.Symlink(next, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+		next = "/" + name
+	}
+	return next
+}
+
+func TestMaxSymlinks(t *testing.T) {
+	for _, tc := range []struct {
+		links int
+		valid bool
+	}{
+		{1, true},
+		{maxSymlinks, true},
+		{maxSymlinks + 1, false},
+	} {
+		dir := t.TempDir()
+		path, err := JoinAndResolveWithRelativeRoot(dir, symlinkChain(t, dir, tc.links))
+		if tc.valid && err != nil {
+			t.Errorf("resolving %d symlinks failed: %v", tc.links, err)
+		}
+		if tc.valid && err == nil && UnsafeAbsolute(path.Raw()) != filepath.Join(dir, "target") {
+			t.Errorf("%d symlinks resolved to %s", tc.links, path)
+		}
+		if !tc.valid && !errors.Is(err, syscall.ELOOP) {
+			t.Errorf("resolving %d symlinks didn't fail with ELOOP: %v", tc.links, err)
+		}
+	}
+}
+
+func TestMaxSymlinksFlag(t *testing.T) {
+	dir := t.TempDir()
+	// the link is resolved below the --chroot-base
+	link := symlinkChain(t, dir, 3)
+	if out, err := virtChroot("--chroot-base", dir, "--max-symlinks", "2", "chmod", "--follow", "0600", link).CombinedOutput(); err == nil {
+		t.Errorf("following 3 symlinks with --max-symlinks 2 succeeded: %s", out)
+	}
+	if out, err := virtChroot("--chroot-base", dir, "--max-symlinks", "3", "chmod", "--follow", "0600", link).CombinedOutput(); err != nil {
+		t.Errorf("following 3 symlinks with --max-symlinks 3 failed: %v\n%s", err, out)
+	}
+	if mode := modeOf(t, filepath.Join(dir, "target")); mode != 0600 {
+		t.Errorf("target has mode %v instead of 0600", mode)
+	}
+}
+
+func TestSafePathFdsCloseOnExec(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	isCloseOnExec := func(name string, fd int) {
+		t.Helper()
+		defer unix.Close(fd)
+		flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags&unix.FD_CLOEXEC == 0 {
+			t.Errorf("%s returned a descriptor without FD_CLOEXEC", name)
+		}
+	}
+	fd, err := open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isCloseOnExec("open", fd)
+	parent, err := open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(parent)
+	if fd, err = openat(parent, "file"); err != nil {
+		t.Fatal(err)
+	}
+	isCloseOnExec("openat", fd)
+	if fd, err = touchat(parent, "new", 0644); err != nil {
+		t.Fatal(err)
+	}
+	isCloseOnExec("touchat", fd)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const onlineCPUsPath = "/sys/devices/system/cpu/online"
+
+// maxCPUs is the number of cpus a unix.CPUSet can hold, its words are 32 bit
+// on 32 bit architectures. Larger cpu numbers are rejected before ranges are
+// expanded.
+var maxCPUs = int(unsafe.Sizeof(unix.CPUSet{})) * 8
+
+// parseCPUList parses a list of cpus in the format of cpuset(7), e.g. 0-3,7.
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, item := range strings.Split(strings.TrimSpace(list), ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid cpu list %q", list)
+		}
+		if start >= maxCPUs {
+			return nil, fmt.Errorf("cpu %d in cpu list %q is out of range, at most %d cpus are supported", start, list, maxCPUs)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpu list %q", list)
+			}
+			if end >= maxCPUs {
+				return nil, fmt.Errorf("cpu %d in cpu list %q is out of range, at most %d cpus are supported", end, list, maxCPUs)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// setCPUAffinity pins the current thread, and with it the executed command,
+// to the cpus in list. All of them have to be online.
+func setCPUAffinity(list string) error {
+	cpus, err := parseCPUList(list)
+	if err != nil {
+		return usageError(err)
+	}
+	online, err := os.ReadFile(onlineCPUsPath)
+	if err != nil {
+		return fmt.Errorf("failed to read the online cpus: %w", err)
+	}
+	onlineCPUs, err := parseCPUList(string(online))
+	if err != nil {
+		return fmt.Errorf("failed to parse the online cpus: %w", err)
+	}
+	isOnline := map[int]bool{}
+	for _, cpu := range onlineCPUs {
+		isOnline[cpu] = true
+	}
+
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		if !isOnline[cpu] {
+			return usageError(fmt.Errorf("cpu %d is not online, online cpus are %s", cpu, strings.TrimSpace(string(online))))
+		}
+		set.Set(cpu)
+	}
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		return fmt.Errorf("failed to set the cpu affinity: %w", err)
+	}
+	return nil
+}
+
+const (
+	ioprioClassShift  = 13
+	ioprioWhoProcess  = 1
+	ioprioLevelsLimit = 8
+)
+
+var ioprioClasses = map[string]int{
+	"none":        0,
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// parseIOPriority parses CLASS:LEVEL, e.g. best-effort:7, into the ioprio
+// value passed to ioprio_set. The idle class takes no level.
+func parseIOPriority(value string) (int, error) {
+	name, levelValue, hasLevel := strings.Cut(value, ":")
+	class, ok := ioprioClasses[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown io scheduling class %q, expected none, realtime, best-effort or idle", name)
+	}
+	level := 0
+	if hasLevel {
+		var err error
+		level, err = strconv.Atoi(levelValue)
+		if err != nil || level < 0 || level >= ioprioLevelsLimit {
+			return 0, fmt.Errorf("io scheduling level must be between 0 and %d, got %q", ioprioLevelsLimit-1, levelValue)
+		}
+		if name == "idle" || name == "none" {
+			return 0, fmt.Errorf("io scheduling class %s takes no level", name)
+		}
+	}
+	return class<<ioprioClassShift | level, nil
+}
+
+// setIOPriority sets the io scheduling class and level of the current thread,
+// the executed command inherits it.
+func setIOPriority(value string) error {
+	ioprio, err := parseIOPriority(value)
+	if err != nil {
+		return usageError(err)
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(ioprio))
+	if errno == unix.EPERM {
+		return fmt.Errorf("failed to set the io priority, the realtime class requires CAP_SYS_ADMIN: %w", errno)
+	}
+	if errno != 0 {
+		return fmt.Errorf("failed to set the io priority: %w", errno)
+	}
+	return nil
+}
+
+// setNice sets the niceness of the current thread, the executed command
+// inherits it.
+func setNice(nice int) error {
+	if nice < -20 || nice > 19 {
+		return usageError(fmt.Errorf("--nice must be between -20 and 19"))
+	}
+	err := unix.Setpriority(unix.PRIO_PROCESS, 0, nice)
+	if err == unix.EPERM || err == unix.EACCES {
+		return fmt.Errorf("failed to set the niceness, raising the priority requires CAP_SYS_NICE or a matching RLIMIT_NICE: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set the niceness: %w", err)
+	}
+	return nil
+}
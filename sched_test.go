@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	for _, tc := range []struct {
+		list  string
+		cpus  []int
+		valid bool
+	}{
+		{"0", []int{0}, true},
+		{"0-3,7", []int{0, 1, 2, 3, 7}, true},
+		{" 2,4-5\n", []int{2, 4, 5}, true},
+		{"3-3", []int{3}, true},
+		{"", nil, false},
+		{"3-1", nil, false},
+		{"-1", nil, false},
+		{"0,,1", nil, false},
+		{"0-", nil, false},
+		{"a", nil, false},
+		{fmt.Sprintf("%d", maxCPUs-1), []int{maxCPUs - 1}, true},
+		{fmt.Sprintf("%d", maxCPUs), nil, false},
+		{"0-2000000000", nil, false},
+	} {
+		cpus, err := parseCPUList(tc.list)
+		if tc.valid != (err == nil) {
+			t.Errorf("parsing %q returned error %v", tc.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(cpus, tc.cpus) {
+			t.Errorf("parsing %q returned %v instead of %v", tc.list, cpus, tc.cpus)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// offsets into struct seccomp_data
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+var auditArches = map[string]uint32{
+	"386":     unix.AUDIT_ARCH_I386,
+	"amd64":   unix.AUDIT_ARCH_X86_64,
+	"arm":     unix.AUDIT_ARCH_ARM,
+	"arm64":   unix.AUDIT_ARCH_AARCH64,
+	"ppc64le": unix.AUDIT_ARCH_PPC64LE,
+	"s390x":   unix.AUDIT_ARCH_S390X,
+}
+
+// seccompProfiles are the built-in profiles which can be passed to --seccomp
+// instead of a path to a BPF program.
+var seccompProfiles = map[string]func() ([]unix.SockFilter, error){
+	"deny-all-but-exec": denyAllButExecProfile,
+}
+
+// loadSeccompFilter returns the built-in profile with the given name, or reads
+// the BPF program from the file at the given path. The file has to contain the
+// raw struct sock_filter array as e.g. exported by seccomp_export_bpf(3).
+func loadSeccompFilter(profile string) ([]unix.SockFilter, error) {
+	if builtin, ok := seccompProfiles[profile]; ok {
+		return builtin()
+	}
+	data, err := os.ReadFile(profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp filter: %w", err)
+	}
+	size := int(unsafe.Sizeof(unix.SockFilter{}))
+	if len(data) == 0 || len(data)%size != 0 {
+		return nil, fmt.Errorf("seccomp filter %s is not a valid BPF program", profile)
+	}
+	filter := make([]unix.SockFilter, len(data)/size)
+	for i := range filter {
+		instruction := data[i*size : (i+1)*size]
+		filter[i] = unix.SockFilter{
+			Code: binary.NativeEndian.Uint16(instruction[0:2]),
+			Jt:   instruction[2],
+			Jf:   instruction[3],
+			K:    binary.NativeEndian.Uint32(instruction[4:8]),
+		}
+	}
+	return filter, nil
+}
+
+// installSeccompFilter installs the filter for the calling thread. It sets
+// no_new_privs first, since the kernel refuses unprivileged filters without it.
+func installSeccompFilter(filter []unix.SockFilter) error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+		return fmt.Errorf("failed to install seccomp filter: %w", err)
+	}
+	return nil
+}
+
+// runtimeSyscalls are the syscalls a process needs to load, run and exit,
+// which denyAllButExecProfile permits in addition to execve and execveat.
+// seccompArchSyscalls holds the ones which differ between architectures.
+var runtimeSyscalls = []uintptr{
+	unix.SYS_EXECVE,
+	unix.SYS_EXECVEAT,
+	unix.SYS_EXIT,
+	unix.SYS_EXIT_GROUP,
+	unix.SYS_BRK,
+	unix.SYS_MUNMAP,
+	unix.SYS_MPROTECT,
+	unix.SYS_MADVISE,
+	unix.SYS_READ,
+	unix.SYS_WRITE,
+	unix.SYS_READV,
+	unix.SYS_WRITEV,
+	unix.SYS_PREAD64,
+	unix.SYS_CLOSE,
+	unix.SYS_OPENAT,
+	unix.SYS_FSTAT,
+	unix.SYS_STATX,
+	unix.SYS_FACCESSAT,
+	unix.SYS_FACCESSAT2,
+	unix.SYS_READLINKAT,
+	unix.SYS_LSEEK,
+	unix.SYS_FCNTL,
+	unix.SYS_IOCTL,
+	unix.SYS_RT_SIGRETURN,
+	unix.SYS_RT_SIGACTION,
+	unix.SYS_RT_SIGPROCMASK,
+	unix.SYS_SIGALTSTACK,
+	unix.SYS_SET_TID_ADDRESS,
+	unix.SYS_SET_ROBUST_LIST,
+	unix.SYS_RSEQ,
+	unix.SYS_FUTEX,
+	unix.SYS_PRLIMIT64,
+	unix.SYS_GETRANDOM,
+	unix.SYS_UNAME,
+	unix.SYS_CLOCK_GETTIME,
+	unix.SYS_GETPID,
+	unix.SYS_GETTID,
+	unix.SYS_TGKILL,
+	unix.SYS_GETUID,
+	unix.SYS_GETEUID,
+	unix.SYS_GETGID,
+	unix.SYS_GETEGID,
+}
+
+// denyAllButExecProfile only permits execve, execveat and the runtimeSyscalls
+// the executed program needs to start and exit, e.g. mmap and exit_group. All
+// other syscalls fail with EPERM. Syscalls of a foreign architecture kill the
+// process.
+func denyAllButExecProfile() ([]unix.SockFilter, error) {
+	arch, ok := auditArches[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("built-in seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+	allowed := append(append([]uintptr{}, runtimeSyscalls...), seccompArchSyscalls...)
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArch},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_KILL_PROCESS},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNr},
+	}
+	for i, nr := range allowed {
+		// jump over the remaining comparisons and the EPERM return
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: uint8(len(allowed) - i), K: uint32(nr)})
+	}
+	return append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+	), nil
+}
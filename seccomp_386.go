@@ -0,0 +1,18 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// seccompArchSyscalls are the runtimeSyscalls specific to 386.
+var seccompArchSyscalls = []uintptr{
+	unix.SYS_MMAP2,
+	unix.SYS_FSTATAT64,
+	unix.SYS_FSTAT64,
+	unix.SYS__LLSEEK,
+	unix.SYS_FCNTL64,
+	unix.SYS_SET_THREAD_AREA,
+	unix.SYS_ACCESS,
+	unix.SYS_OPEN,
+	unix.SYS_STAT64,
+	unix.SYS_READLINK,
+	unix.SYS_CLOCK_GETTIME64,
+}
@@ -0,0 +1,14 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// seccompArchSyscalls are the runtimeSyscalls specific to amd64.
+var seccompArchSyscalls = []uintptr{
+	unix.SYS_MMAP,
+	unix.SYS_NEWFSTATAT,
+	unix.SYS_ARCH_PRCTL,
+	unix.SYS_ACCESS,
+	unix.SYS_OPEN,
+	unix.SYS_STAT,
+	unix.SYS_READLINK,
+}
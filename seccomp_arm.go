@@ -0,0 +1,19 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// seccompArchSyscalls are the runtimeSyscalls specific to arm.
+var seccompArchSyscalls = []uintptr{
+	unix.SYS_MMAP2,
+	unix.SYS_FSTATAT64,
+	unix.SYS_FSTAT64,
+	unix.SYS__LLSEEK,
+	unix.SYS_FCNTL64,
+	unix.SYS_ACCESS,
+	unix.SYS_OPEN,
+	unix.SYS_STAT64,
+	unix.SYS_READLINK,
+	unix.SYS_CLOCK_GETTIME64,
+	// __ARM_NR_set_tls, which is not part of the syscall table
+	0xf0005,
+}
@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// seccompArchSyscalls are the runtimeSyscalls specific to arm64.
+var seccompArchSyscalls = []uintptr{
+	unix.SYS_MMAP,
+	unix.SYS_FSTATAT,
+}
@@ -0,0 +1,13 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// seccompArchSyscalls are the runtimeSyscalls specific to ppc64le.
+var seccompArchSyscalls = []uintptr{
+	unix.SYS_MMAP,
+	unix.SYS_NEWFSTATAT,
+	unix.SYS_ACCESS,
+	unix.SYS_OPEN,
+	unix.SYS_STAT,
+	unix.SYS_READLINK,
+}
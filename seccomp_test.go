@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestDenyAllButExecProfile(t *testing.T) {
+	if _, err := denyAllButExecProfile(); err != nil {
+		t.Skip(err)
+	}
+	if out, err := virtChroot("exec", "--seccomp", "deny-all-but-exec", "--", "/bin/sh", "-c", "echo started").CombinedOutput(); err != nil || string(out) != "started\n" {
+		t.Fatalf("a shell can't run under the profile: %v\n%s", err, out)
+	}
+
+	dir := filepath.Join(t.TempDir(), "denied")
+	err := virtChroot("exec", "--seccomp", "deny-all-but-exec", "--", "/bin/mkdir", dir).Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("mkdir wasn't denied: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("mkdir created %s under the profile", dir)
+	}
+}
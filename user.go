@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// parseNumericUser parses a user given as uid or uid:gid, which allows to
+// switch to users without an entry in the user database. If only a uid is
+// given, it is used as gid too. numeric is false if the user is not given
+// in numeric form and has to be looked up.
+func parseNumericUser(s string) (uid, gid int, numeric bool, err error) {
+	uidStr, gidStr, found := strings.Cut(s, ":")
+	if !isNumeric(uidStr) || (found && !isNumeric(gidStr)) {
+		return 0, 0, false, nil
+	}
+	parsedUID, err := strconv.ParseInt(uidStr, 10, 32)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to parse uid: %w", err)
+	}
+	parsedGID := parsedUID
+	if found {
+		parsedGID, err = strconv.ParseInt(gidStr, 10, 32)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("failed to parse gid: %w", err)
+		}
+	}
+	return int(parsedUID), int(parsedGID), true, nil
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// userIDs returns the uid and primary gid of the user.
+func userIDs(u *user.User) (uid, gid int, err error) {
+	parsedUID, err := strconv.ParseInt(u.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse uid: %w", err)
+	}
+	parsedGID, err := strconv.ParseInt(u.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse gid: %w", err)
+	}
+	return int(parsedUID), int(parsedGID), nil
+}
+
+// userGroups returns the gids of all groups the user is a member of.
+// If the groups can't be looked up nil is returned.
+func userGroups(u *user.User) []int {
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil
+	}
+	groups := make([]int, 0, len(ids))
+	for _, id := range ids {
+		gid, err := strconv.ParseInt(id, 10, 32)
+		if err != nil {
+			return nil
+		}
+		groups = append(groups, int(gid))
+	}
+	return groups
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseNumericUser(t *testing.T) {
+	for _, tc := range []struct {
+		user     string
+		uid, gid int
+		numeric  bool
+		valid    bool
+	}{
+		{"1000", 1000, 1000, true, true},
+		{"1000:2000", 1000, 2000, true, true},
+		{"0:0", 0, 0, true, true},
+		{"nobody", 0, 0, false, true},
+		{"1000:users", 0, 0, false, true},
+		{"user1", 0, 0, false, true},
+		{"1000:", 0, 0, false, true},
+		{"-1", 0, 0, false, true},
+		{"4294967296", 0, 0, false, false},
+		{"1000:4294967296", 0, 0, false, false},
+	} {
+		uid, gid, numeric, err := parseNumericUser(tc.user)
+		if tc.valid != (err == nil) {
+			t.Errorf("parsing %q returned error %v", tc.user, err)
+			continue
+		}
+		if uid != tc.uid || gid != tc.gid || numeric != tc.numeric {
+			t.Errorf("parsing %q returned %d:%d numeric %v instead of %d:%d numeric %v", tc.user, uid, gid, numeric, tc.uid, tc.gid, tc.numeric)
+		}
+	}
+}
+
+// setuidHelper copies id to a directory other users can access and makes it
+// setuid root.
+func setuidHelper(t *testing.T) string {
+	t.Helper()
+	requireRoot(t)
+	idPath, err := exec.LookPath("id")
+	if err != nil {
+		t.Skip("id is not available")
+	}
+	dir, err := os.MkdirTemp("", "virt-chroot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	source, err := os.Open(idPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	helper := filepath.Join(dir, "id")
+	target, err := os.OpenFile(helper, os.O_CREATE|os.O_WRONLY, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	if _, err := io.Copy(target, source); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Chmod(0755 | os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	return helper
+}
+
+func TestNoNewPrivs(t *testing.T) {
+	helper := setuidHelper(t)
+	out, err := virtChroot("--user", "65534", "exec", "--", helper, "-u").CombinedOutput()
+	if err != nil {
+		t.Fatalf("exec failed: %v\n%s", err, out)
+	}
+	if strings.TrimSpace(string(out)) != "0" {
+		t.Skipf("the setuid helper doesn't elevate, e.g. on a nosuid mount: %s", out)
+	}
+	out, err = virtChroot("--user", "65534", "--no-new-privs", "exec", "--", helper, "-u").CombinedOutput()
+	if err != nil {
+		t.Fatalf("exec failed: %v\n%s", err, out)
+	}
+	if strings.TrimSpace(string(out)) != "65534" {
+		t.Fatalf("the setuid helper elevated to %s despite --no-new-privs", out)
+	}
+}
+
+func TestDropCaps(t *testing.T) {
+	requireRoot(t)
+	out, err := virtChroot("--user", "65534", "--keep-caps", "CAP_CHOWN,CAP_KILL", "exec", "--", "/bin/grep", "CapBnd", "/proc/self/status").CombinedOutput()
+	if err != nil {
+		t.Fatalf("exec failed: %v\n%s", err, out)
+	}
+	// CAP_CHOWN is 0 and CAP_KILL is 5
+	if got := strings.TrimSpace(string(out)); got != "CapBnd:\t0000000000000021" {
+		t.Fatalf("unexpected bounding set %q", got)
+	}
+}
+
+func TestDropCapsAsRoot(t *testing.T) {
+	requireRoot(t)
+	cmd := virtChroot("--keep-caps", "CAP_CHOWN,CAP_KILL", "exec", "--", "/bin/grep", "-E", "Cap(Inh|Amb|Bnd)", "/proc/self/status")
+	// start with inheritable and ambient capabilities which have to be dropped
+	cmd.SysProcAttr = &syscall.SysProcAttr{AmbientCaps: []uintptr{unix.CAP_CHOWN, unix.CAP_SYS_ADMIN}}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("exec failed: %v\n%s", err, out)
+	}
+	// only CAP_CHOWN was inheritable and is kept
+	expected := "CapInh:\t0000000000000001\nCapBnd:\t0000000000000021\nCapAmb:\t0000000000000000"
+	if got := strings.TrimSpace(string(out)); got != expected {
+		t.Fatalf("unexpected capability sets %q", got)
+	}
+}
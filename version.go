@@ -0,0 +1,16 @@
+package main
+
+// Build metadata, injected at build time, e.g. with
+//
+//	go build -ldflags "-X main.version=v1.0.0 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "devel"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	BuildDate string `json:"buildDate"`
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+const selinuxXattr = "security.selinux"
+
+// RelabelAtNoFollow sets the SELinux context of name relative to parent.
+// Symlinks are relabeled themselves and never followed. With recursive, the
+// whole subtree below a directory is relabeled too.
+func RelabelAtNoFollow(parent *Path, name, label string, recursive bool) error {
+	if err := isSingleElement(name); err != nil {
+		return err
+	}
+	f, err := OpenAtNoFollow(parent)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := relabelAt(f.fd, name, label, recursive); err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return fmt.Errorf("failed relabeling %s in %v, the kernel or filesystem lacks SELinux or xattr support: %w", name, parent, err)
+		}
+		return fmt.Errorf("failed relabeling %s in %v: %w", name, parent, err)
+	}
+	return nil
+}
+
+func relabelAt(dirfd int, name, label string, recursive bool) error {
+	// the file descriptor path resolves the parent, the final element is
+	// not followed by lsetxattr
+	if err := unix.Lsetxattr(filepath.Join(path(dirfd), name), selinuxXattr, []byte(label), 0); err != nil {
+		return err
+	}
+	if !recursive {
+		return nil
+	}
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.ELOOP) {
+		// not a directory or a symlink, nothing below it
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	defer dir.Close()
+	for {
+		names, err := dir.Readdirnames(128)
+		for _, child := range names {
+			if err := relabelAt(fd, child, label, recursive); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// GetxattrRawNoFollow returns the raw value of the extended attribute attr
+// of the file at path. Like GetxattrNoFollow it uses the file descriptor path
+// in proc, the O_PATH file descriptors of the SafePath helpers can't be used
+// with the f*xattr calls and reopening the file could open fifos or devices.
+func GetxattrRawNoFollow(path *Path, attr string) ([]byte, error) {
+	pathFd, err := OpenAtNoFollow(path)
+	if err != nil {
+		return nil, err
+	}
+	defer pathFd.Close()
+	for {
+		size, err := unix.Getxattr(pathFd.SafePath(), attr, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading attribute %s of %v: %w", attr, path, err)
+		}
+		value := make([]byte, size)
+		size, err = unix.Getxattr(pathFd.SafePath(), attr, value)
+		if errors.Is(err, syscall.ERANGE) {
+			// the value grew in between
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed reading attribute %s of %v: %w", attr, path, err)
+		}
+		return value[:size], nil
+	}
+}
+
+// ListxattrNoFollow returns the names of all extended attributes of the file
+// at path.
+func ListxattrNoFollow(path *Path) ([]string, error) {
+	pathFd, err := OpenAtNoFollow(path)
+	if err != nil {
+		return nil, err
+	}
+	defer pathFd.Close()
+	for {
+		size, err := unix.Listxattr(pathFd.SafePath(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed listing attributes of %v: %w", path, err)
+		}
+		list := make([]byte, size)
+		size, err = unix.Listxattr(pathFd.SafePath(), list)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed listing attributes of %v: %w", path, err)
+		}
+		names := []string{}
+		for _, name := range bytes.Split(list[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// SetxattrNoFollow sets the extended attribute attr of the file at path.
+func SetxattrNoFollow(path *Path, attr string, value []byte) error {
+	pathFd, err := OpenAtNoFollow(path)
+	if err != nil {
+		return err
+	}
+	defer pathFd.Close()
+	if err := unix.Setxattr(pathFd.SafePath(), attr, value, 0); err != nil {
+		return fmt.Errorf("failed setting attribute %s of %v: %w", attr, path, err)
+	}
+	return nil
+}
+
+// xattrBase64Prefix marks base64 encoded attribute values, like getfattr does.
+const xattrBase64Prefix = "0s"
+
+func encodeXattrValue(value []byte) string {
+	if utf8.Valid(value) {
+		return string(value)
+	}
+	return xattrBase64Prefix + base64.StdEncoding.EncodeToString(value)
+}
+
+func decodeXattrValue(value string) ([]byte, error) {
+	if !strings.HasPrefix(value, xattrBase64Prefix) {
+		return []byte(value), nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, xattrBase64Prefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 attribute value: %w", err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrValueEncoding(t *testing.T) {
+	for _, value := range [][]byte{[]byte("plain"), {0xff, 0x00, 0x01}, {}} {
+		decoded, err := decodeXattrValue(encodeXattrValue(value))
+		if err != nil {
+			t.Fatalf("decoding %q failed: %v", value, err)
+		}
+		if string(decoded) != string(value) {
+			t.Errorf("%q was decoded as %q", value, decoded)
+		}
+	}
+	if _, err := decodeXattrValue(xattrBase64Prefix + "!"); err == nil {
+		t.Errorf("invalid base64 was decoded")
+	}
+}
+
+func TestXattrOnFifo(t *testing.T) {
+	requireRoot(t)
+	fifo := filepath.Join(t.TempDir(), "fifo")
+	if err := unix.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	path, err := NewPathNoFollow(fifo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// opening the fifo for reading would block without a writer
+	err = SetxattrNoFollow(path, "trusted.test", []byte{0xff, 0x01})
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("the filesystem doesn't support extended attributes")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := GetxattrRawNoFollow(path, "trusted.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "\xff\x01" {
+		t.Errorf("unexpected attribute value %q", value)
+	}
+	names, err := ListxattrNoFollow(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(names, ","), "trusted.test") {
+		t.Errorf("trusted.test is not listed in %v", names)
+	}
+}